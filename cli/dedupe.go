@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	log "github.com/sirupsen/logrus"
+)
+
+func runDedupe(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("dedupe", "", "")
+	var threshold float64
+	var merge bool
+	fs.Float64Var(&threshold, "threshold", 0.9, "minimal similarity (0..1) of normalized texts to consider annotations duplicates")
+	fs.BoolVar(&merge, "merge", false, "merge the near-duplicates instead of only showing them")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if threshold <= 0 || threshold > 1 {
+		return invalidUsage(fs, "Threshold must be in range (0, 1], got %v", threshold)
+	}
+
+	db, err := o.openDatabase()
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	if err := model.Migrate(ctx, db); err != nil {
+		return fmt.Errorf("failed to migrate the database schema: %w", err)
+	}
+	deduper := model.NewDBAnnotationDeduper(db)
+
+	groups, err := deduper.FindDuplicateAnnotations(ctx, threshold)
+	if err != nil {
+		return fmt.Errorf("failed to find duplicate annotations: %w", err)
+	}
+	if len(groups) == 0 {
+		fmt.Println("No near-duplicate annotations found")
+		return nil
+	}
+	for i, g := range groups {
+		fmt.Printf("Group %d (book #%d):\n", i+1, g[0].BookId)
+		for j, a := range g {
+			marker := "merge"
+			if j == 0 {
+				marker = "keep "
+			}
+			fmt.Printf("  [%s] #%d %q\n", marker, a.Id, a.Text)
+		}
+	}
+	if !merge {
+		fmt.Println("Run with -merge to merge the near-duplicates")
+		return nil
+	}
+	merged := 0
+	for i, g := range groups {
+		survivor := g[0]
+		if err := deduper.MergeAnnotations(ctx, &survivor, g[1:]); err != nil {
+			return fmt.Errorf("failed to merge group %d: %w", i+1, err)
+		}
+		merged += len(g) - 1
+	}
+	log.Infof("Merged %d near-duplicate annotations", merged)
+	return nil
+}
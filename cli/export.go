@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	"os"
+	"strings"
+)
+
+func runExport(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("export", "[query]", "Exports all annotations, or only those matching the query (see tt help query).")
+	var format, output, order string
+	var includeDeleted bool
+	fs.StringVar(&format, "format", "json", "output format: json or csv")
+	fs.StringVar(&output, "output", "", "file to write to, standard output if empty")
+	fs.StringVar(&order, "order", "location", "order of annotations: id, location, ts, or chapter (grouped by book and chapter)")
+	fs.BoolVar(&includeDeleted, "include-deleted", false, "include annotations soft-deleted by reconciliation")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if format != "json" && format != "csv" {
+		return invalidUsage(fs, "Unknown output format %q, it has to be json or csv", format)
+	}
+	return exportAnnotations(ctx, o, output, format, strings.Join(fs.Args(), " "), order, includeDeleted)
+}
+
+// exportAnnotations writes annotations matching the query to the file, or to standard output if it is empty
+func exportAnnotations(ctx context.Context, o *options, output string, format string, query string, order string, includeDeleted bool) (err error) {
+	w := os.Stdout
+	if output != "" {
+		if w, err = os.Create(output); err != nil {
+			return fmt.Errorf("failed to create %v: %w", output, err)
+		}
+		defer utils.SafeClose(w, &err)
+	}
+	return queryAnnotations(ctx, o, []string{query}, order, 0, includeDeleted, w, outputFormats[format])
+}
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"strconv"
+)
+
+func runHistory(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("history", "annotation-id", "")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return invalidUsage(fs, "Exactly one annotation Id is expected")
+	}
+	annotationId, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return invalidUsage(fs, "Invalid annotation Id %q", fs.Arg(0))
+	}
+
+	db, err := o.openExistingDatabase()
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	if err := model.Migrate(ctx, db); err != nil {
+		return fmt.Errorf("failed to migrate the database schema: %w", err)
+	}
+	entries, err := model.NewDBAnnotationHistory(db).ListAnnotationHistory(ctx, annotationId)
+	if err != nil {
+		return fmt.Errorf("failed to read the history: %w", err)
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No recorded changes of annotation #%d\n", annotationId)
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Printf("%s [%s] ", e.ChangedAt.Format("2006-01-02 15:04:05"), e.Cause)
+		switch e.Field {
+		case model.HistoryCreated:
+			fmt.Printf("created: %q\n", e.NewValue)
+		case model.HistoryDeleted:
+			fmt.Printf("deleted: %q\n", e.OldValue)
+		default:
+			fmt.Printf("%s: %q -> %q\n", e.Field, e.OldValue, e.NewValue)
+		}
+	}
+	return nil
+}
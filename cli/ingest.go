@@ -0,0 +1,486 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/kindle"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"github.com/milanaleksic/tt-extractor-kindle/oreilly"
+	"github.com/milanaleksic/tt-extractor-kindle/plugin"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var extractors = model.NewExtractorRegistry(
+	func(books model.BookRepository, annotations model.AnnotationRepository, origin string) model.ResumableExtractor {
+		return kindle.NewContentExtractor(books, annotations, origin)
+	},
+	func(books model.BookRepository, annotations model.AnnotationRepository, _ string) model.ResumableExtractor {
+		return oreilly.NewContentExtractor(books, annotations)
+	},
+	func(books model.BookRepository, annotations model.AnnotationRepository, origin string) model.ResumableExtractor {
+		return plugin.NewContentExtractor(books, annotations, origin)
+	},
+)
+
+// ingestCommands have flags specific to their source; any registered format can be ingested by runIngestFiles
+var ingestCommands = map[string]func(ctx context.Context, args []string) error{
+	kindle.Source:  runIngestKindle,
+	oreilly.Source: runIngestOreilly,
+}
+
+func ingestSources() []string {
+	return extractors.Names()
+}
+
+func runIngest(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		if run, ok := ingestCommands[args[0]]; ok {
+			return run(ctx, args[1:])
+		}
+	}
+	return runIngestFiles(ctx, args)
+}
+
+// runIngestFiles detects the format of each file and ingests it with the matching extractor
+func runIngestFiles(ctx context.Context, args []string) error {
+	fs, i := newIngestion("ingest", "file... | -plugin command [argument...]", "The format of each file ("+strings.Join(extractors.Names(), ", ")+
+		") is detected from its content.\n"+
+		"Use tt ingest <source> [flags] to ingest with the flags specific to a source, see tt help ingest <source>.\n"+
+		"With -plugin, the command is run with the arguments and what it writes as JSON Lines is ingested.")
+	var pluginCommand string
+	fs.StringVar(&pluginCommand, "plugin", "", "run this external extractor and ingest its output (JSON Lines protocol "+
+		"version "+strconv.Itoa(plugin.ProtocolVersion)+")")
+	if err := i.parse(fs, args); err != nil {
+		return err
+	}
+	if pluginCommand != "" {
+		return runPlugin(ctx, i, pluginCommand, fs.Args())
+	}
+	if fs.NArg() == 0 {
+		return invalidUsage(fs, "Files to ingest are missing")
+	}
+	// all files are detected first, so that an unknown one fails before anything is ingested
+	formats := make(map[string]string)
+	for _, location := range fs.Args() {
+		if err := ingestFile(location, func(f *os.File) (err error) {
+			formats[location], _, err = extractors.DetectInput(f)
+			return err
+		}); err != nil {
+			return fmt.Errorf("%v: %w", location, err)
+		}
+		log.Debugf("Detected %v as %v", location, formats[location])
+	}
+	if err := i.start(ctx); err != nil {
+		return err
+	}
+	defer i.close()
+
+	books, annotations := i.repositories()
+	for _, location := range fs.Args() {
+		source := formats[location]
+		if err := ingestFile(location, func(f *os.File) error {
+			extractor, err := extractors.New(source, books, annotations, f.Name())
+			if err != nil {
+				return err
+			}
+			runSource, err := importRunSource(source, f)
+			if err != nil {
+				return err
+			}
+			log.Infof("Ingesting %v as %v", location, source)
+			return i.ingest(ctx, extractor, &model.ImportRun{Source: runSource, Origin: f.Name()}, f)
+		}); err != nil {
+			return err
+		}
+	}
+	i.printChanges()
+	return nil
+}
+
+// runPlugin ingests what the plugin writes to its standard output
+func runPlugin(ctx context.Context, i *ingestion, command string, args []string) error {
+	if err := i.start(ctx); err != nil {
+		return err
+	}
+	defer i.close()
+	if err := i.ingestPlugin(ctx, command, args, ""); err != nil {
+		return err
+	}
+	i.printChanges()
+	return nil
+}
+
+// ingestPlugin runs the plugin and ingests its output; the standard error of the plugin is passed through.
+// Origin is the command line, unless given
+func (i *ingestion) ingestPlugin(ctx context.Context, command string, args []string, origin string) error {
+	cmd := exec.Command(command, args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to run plugin %v: %w", command, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run plugin %v: %w", command, err)
+	}
+	output := &pluginOutput{ctx: ctx, reader: stdout, cmd: cmd}
+	defer output.stop()
+
+	// the source of the import run is the one the plugin writes in its header
+	buffered := bufio.NewReader(output)
+	first, err := buffered.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read the output of plugin %v: %w", command, err)
+	}
+	header, err := plugin.ParseHeader(first)
+	if err != nil {
+		return fmt.Errorf("plugin %v: %w", command, err)
+	}
+	if origin == "" {
+		origin = strings.Join(append([]string{command}, args...), " ")
+	}
+	books, annotations := i.repositories()
+	extractor := plugin.NewContentExtractor(books, annotations, origin)
+	return i.ingest(ctx, extractor, &model.ImportRun{Source: header.Source, Origin: origin}, io.MultiReader(bytes.NewReader(first), buffered))
+}
+
+// pluginOutput reads the output of the plugin and fails at its end if the plugin did not exit successfully,
+// so that nothing of a failed run is committed
+type pluginOutput struct {
+	ctx    context.Context
+	reader io.Reader
+	cmd    *exec.Cmd
+	exited bool
+}
+
+func (o *pluginOutput) Read(p []byte) (int, error) {
+	n, err := o.reader.Read(p)
+	if err == io.EOF && !o.exited {
+		o.exited = true
+		if err := o.cmd.Wait(); err != nil {
+			if o.ctx.Err() != nil {
+				// the plugin got the interrupt as well, what was read until then is kept
+				return n, o.ctx.Err()
+			}
+			return n, fmt.Errorf("plugin %v failed: %w", o.cmd.Path, err)
+		}
+	}
+	return n, err
+}
+
+// stop kills the plugin when ingestion ended before reading all of its output
+func (o *pluginOutput) stop() {
+	if o.exited {
+		return
+	}
+	o.exited = true
+	_ = o.cmd.Process.Kill()
+	_ = o.cmd.Wait()
+}
+
+// ingestion is what all sources share: the flags and the database or dry-run store the annotations are written to
+type ingestion struct {
+	*options
+	batchSize     int
+	dryRun        bool
+	mergePolicies mergePolicyFlags
+
+	db          *sql.DB
+	session     *model.BulkSession
+	checkpoints model.CheckpointRepository
+	runs        model.ImportRunRepository
+	store       *model.MemoryStore
+}
+
+func newIngestion(name string, arguments string, description string) (*flag.FlagSet, *ingestion) {
+	fs, o := newFlagSet(name, arguments, description)
+	i := &ingestion{options: o}
+	fs.IntVar(&i.batchSize, "batch-size", 0, "commit after this many writes (0 means a single transaction per input)")
+	fs.BoolVar(&i.dryRun, "dry-run", false, "only print what would be inserted or updated, without writing to the database")
+	fs.Var(&i.mergePolicies, "merge-policy", "merge policy of a field as [source:]field=policy, can be repeated and overrides "+
+		"the configuration; fields are location, text, ts, origin, type, chapter, external_id, book.name, book.isbn and book.authors, "+
+		"policies are prefer-existing, prefer-incoming, prefer-non-empty, prefer-newest-timestamp and prefer-longer-text "+
+		"(default "+model.DefaultMergePolicies().String()+")")
+	return fs, i
+}
+
+// mergePolicyFlags are the -merge-policy flags, which are applied over the merge policies of the configuration
+type mergePolicyFlags []string
+
+func (m *mergePolicyFlags) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *mergePolicyFlags) Set(value string) error {
+	if err := model.DefaultMergePolicies().Set(value); err != nil {
+		return err
+	}
+	*m = append(*m, value)
+	return nil
+}
+
+// policies are the default merge policies, overridden by the configuration and then by the flags
+func (i *ingestion) policies() (*model.MergePolicies, error) {
+	policies := model.DefaultMergePolicies()
+	if i.config != nil {
+		for _, policy := range i.config.MergePolicies {
+			if err := policies.Set(policy); err != nil {
+				return nil, fmt.Errorf("invalid merge policy in %v: %w", i.config.Location(), err)
+			}
+		}
+	}
+	for _, policy := range i.mergePolicies {
+		_ = policies.Set(policy)
+	}
+	return policies, nil
+}
+
+// ingestFunc is model.Ingest or model.IngestIncrementally
+type ingestFunc func(ctx context.Context, session *model.BulkSession, checkpoints model.CheckpointRepository,
+	runs model.ImportRunRepository, extractor model.ResumableExtractor, run *model.ImportRun, reader io.Reader) error
+
+// start opens what the annotations are written to; close has to be called at the end
+func (i *ingestion) start(ctx context.Context) (err error) {
+	policies, err := i.policies()
+	if err != nil {
+		return err
+	}
+	if i.dryRun {
+		i.store, err = prepareDryRunStore(ctx, i.options)
+		if err == nil {
+			i.store.SetMergePolicies(policies)
+		}
+		return err
+	}
+	if i.db, err = i.openDatabase(); err != nil {
+		return err
+	}
+	if i.session, err = model.NewBulkSession(ctx, i.db, i.batchSize); err != nil {
+		return fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	i.session.SetMergePolicies(policies)
+	if i.checkpoints, err = model.NewDBCheckpointRepository(i.db); err != nil {
+		return fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	if i.runs, err = model.NewDBImportRunRepository(i.db); err != nil {
+		return fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	return nil
+}
+
+func (i *ingestion) close() {
+	if i.db != nil {
+		closeDatabase(i.db)
+	}
+}
+
+func (i *ingestion) repositories() (model.BookRepository, model.AnnotationRepository) {
+	if i.dryRun {
+		return i.store.BookRepository(), i.store.AnnotationRepository()
+	}
+	return i.session.BookRepository(), i.session.AnnotationRepository()
+}
+
+// ingest runs the extractor over the input as a new import run, or only into the store on a dry run
+func (i *ingestion) ingest(ctx context.Context, extractor model.ResumableExtractor, run *model.ImportRun, reader io.Reader) error {
+	return i.ingestWith(ctx, model.Ingest, extractor, run, reader)
+}
+
+func (i *ingestion) ingestWith(ctx context.Context, ingest ingestFunc, extractor model.ResumableExtractor, run *model.ImportRun,
+	reader io.Reader) error {
+	var err error
+	if i.dryRun {
+		err = extractor.IngestRecords(ctx, reader)
+	} else {
+		err = ingest(ctx, i.session, i.checkpoints, i.runs, extractor, run, reader)
+	}
+	var interrupted *model.InterruptedError
+	if errors.As(err, &interrupted) {
+		return fmt.Errorf("%w; run the same command again to resume", err)
+	} else if err != nil {
+		return fmt.Errorf("failed to ingest records of %v: %w", run.Origin, err)
+	}
+	return nil
+}
+
+// printChanges prints what a dry run would have written
+func (i *ingestion) printChanges() {
+	if !i.dryRun {
+		return
+	}
+	counts := make(map[model.ChangeKind]int)
+	for _, c := range i.store.Changes() {
+		fmt.Println(c)
+		counts[c.Kind]++
+	}
+	fmt.Printf("Dry run: %d inserts and %d updates would be written\n", counts[model.Inserted], counts[model.Updated])
+}
+
+// prepareDryRunStore starts from what is already in the database, so that updates are recognized as such
+func prepareDryRunStore(ctx context.Context, o *options) (*model.MemoryStore, error) {
+	if !model.DatabaseExists(o.databaseLocation) {
+		return model.NewMemoryStore(), nil
+	}
+	db, err := o.openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer closeDatabase(db)
+	store, err := model.LoadMemoryStore(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the database: %w", err)
+	}
+	return store, nil
+}
+
+type inputFiles []string
+
+func (i *inputFiles) String() string {
+	return fmt.Sprintf("%v", *i)
+}
+
+func (i *inputFiles) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+func runIngestKindle(ctx context.Context, args []string) error {
+	fs, i := newIngestion("ingest "+kindle.Source, "", "Clippings are read from standard input if there is no -input-file.")
+	var inputFileLocations inputFiles
+	fs.Var(&inputFileLocations, "input-file", "input clipping files")
+	if err := i.parse(fs, args); err != nil {
+		return err
+	}
+	for _, inputFileLocation := range inputFileLocations {
+		if _, err := os.Stat(inputFileLocation); os.IsNotExist(err) {
+			return fmt.Errorf("input file does not exist: %s", inputFileLocation)
+		}
+	}
+	if err := i.start(ctx); err != nil {
+		return err
+	}
+	defer i.close()
+
+	books, annotations := i.repositories()
+	for _, inputFileLocation := range inputFileLocations {
+		if err := ingestFile(inputFileLocation, func(f *os.File) error {
+			contentExtractor := kindle.NewContentExtractor(books, annotations, f.Name())
+			return i.ingest(ctx, contentExtractor, &model.ImportRun{Source: kindle.Source, Origin: f.Name()}, f)
+		}); err != nil {
+			return err
+		}
+	}
+	if len(inputFileLocations) == 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "Reading from stdin")
+		contentExtractor := kindle.NewContentExtractor(books, annotations, "stdin")
+		if err := i.ingest(ctx, contentExtractor, &model.ImportRun{Source: kindle.Source, Origin: "stdin"}, os.Stdin); err != nil {
+			return err
+		}
+	}
+	i.printChanges()
+	return nil
+}
+
+func runIngestOreilly(ctx context.Context, args []string) error {
+	fs, i := newIngestion("ingest "+oreilly.Source, "", "")
+	var csvInput, reconcile, account string
+	fs.StringVar(&csvInput, "csv", "safari-annotations-export.csv", "Exported annotations CSV file")
+	fs.StringVar(&reconcile, "reconcile", "", "after the import, list (\"list\") or soft-delete (\"soft-delete\") "+
+		"O'Reilly annotations which are no longer in the export")
+	fs.StringVar(&account, "account", "", "label of the O'Reilly account the export belongs to, reconcile compares "+
+		"only exports of the same account")
+	if err := i.parse(fs, args); err != nil {
+		return err
+	}
+	if reconcile != "" && reconcile != "list" && reconcile != "soft-delete" {
+		return invalidUsage(fs, "Unknown reconcile mode %q, it has to be list or soft-delete", reconcile)
+	}
+	if reconcile != "" && i.dryRun {
+		return invalidUsage(fs, "Reconciliation needs a real import run, so it can't be combined with -dry-run")
+	}
+	if err := i.start(ctx); err != nil {
+		return err
+	}
+	defer i.close()
+
+	books, annotations := i.repositories()
+	run := &model.ImportRun{Source: oreilly.Source, Origin: csvInput, Account: account}
+	err := ingestFile(csvInput, func(f *os.File) error {
+		return i.ingest(ctx, oreilly.NewContentExtractor(books, annotations), run, f)
+	})
+	if err != nil {
+		return err
+	}
+	i.printChanges()
+	if reconcile != "" {
+		return reconcileRun(ctx, i.db, run, reconcile == "soft-delete")
+	}
+	return nil
+}
+
+func ingestFile(location string, ingest func(f *os.File) error) error {
+	f, err := os.Open(location)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %s, reason: %w", location, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close file %v, err=%v", f.Name(), err)
+		}
+	}()
+	return ingest(f)
+}
+
+// importRunSource is the source an import run of the file records: the format of the file, except for saved output
+// of a plugin, whose annotations carry the source the plugin wrote in its header
+func importRunSource(format string, f *os.File) (string, error) {
+	if format != plugin.Format {
+		return format, nil
+	}
+	first, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read the input: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	header, err := plugin.ParseHeader(first)
+	if err != nil {
+		return "", err
+	}
+	return header.Source, nil
+}
+
+// reconcileRun treats the input as a complete snapshot, so annotations of the source the run did not see are gone
+func reconcileRun(ctx context.Context, db *sql.DB, run *model.ImportRun, softDelete bool) error {
+	reconciler := model.NewDBReconciler(db)
+	if softDelete {
+		deleted, err := reconciler.SoftDeleteMissing(ctx, run)
+		if err != nil {
+			return fmt.Errorf("failed to reconcile: %w", err)
+		}
+		log.Infof("Soft-deleted %d annotations which are no longer in the input (revert import run #%d to restore them)", deleted, run.Id)
+		return nil
+	}
+	missing, err := reconciler.MissingAnnotations(ctx, run)
+	if err != nil {
+		return fmt.Errorf("failed to reconcile: %w", err)
+	}
+	for _, a := range missing {
+		a := a
+		fmt.Println(model.Change{Kind: model.Deleted, Annotation: &a})
+	}
+	if len(missing) > 0 {
+		fmt.Printf("%d annotations are no longer in the input; run with -reconcile soft-delete to delete them\n", len(missing))
+	}
+	return nil
+}
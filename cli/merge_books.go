@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	log "github.com/sirupsen/logrus"
+)
+
+func runMergeBooks(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("merge-books", "", "")
+	var merge bool
+	var group int
+	fs.BoolVar(&merge, "merge", false, "merge the candidate duplicates instead of only showing them")
+	fs.IntVar(&group, "group", 0, "merge only the candidate group with this number (as shown in the listing)")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+
+	db, err := o.openDatabase()
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	if err := model.Migrate(ctx, db); err != nil {
+		return fmt.Errorf("failed to migrate the database schema: %w", err)
+	}
+	merger := model.NewDBBookMerger(db)
+
+	groups, err := merger.FindDuplicateBooks(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find duplicate books: %w", err)
+	}
+	if len(groups) == 0 {
+		fmt.Println("No candidate duplicate books found")
+		return nil
+	}
+	for i, g := range groups {
+		fmt.Printf("Group %d:\n", i+1)
+		for j, book := range g {
+			marker := "merge"
+			if j == 0 {
+				marker = "keep "
+			}
+			fmt.Printf("  [%s] #%d %q by %q (ISBN: %s)\n", marker, book.Id, book.Name, book.Authors, book.Isbn)
+		}
+	}
+	if !merge {
+		fmt.Println("Run with -merge (optionally with -group <number>) to merge the candidates")
+		return nil
+	}
+	if group < 0 || group > len(groups) {
+		return fmt.Errorf("group %d does not exist, there are %d candidate groups", group, len(groups))
+	}
+	for i, g := range groups {
+		if group != 0 && group != i+1 {
+			continue
+		}
+		survivor := g[0]
+		if err := merger.MergeBooks(ctx, &survivor, g[1:]); err != nil {
+			return fmt.Errorf("failed to merge group %d: %w", i+1, err)
+		}
+		log.Infof("Merged %d books into book #%d %q", len(g)-1, survivor.Id, survivor.Name)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+)
+
+func runMigrate(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("migrate", "", "")
+	var status bool
+	fs.BoolVar(&status, "status", false, "only report schema versions, without applying pending migrations")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+
+	open := o.openDatabase
+	if status {
+		open = o.openExistingDatabase
+	}
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	// reading versions must not change the database, even one without the schema_version table
+	current, err := model.SchemaVersion(ctx, db)
+	unversioned := errors.Is(err, model.ErrUnversioned)
+	if err != nil && !unversioned {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	pending, err := model.PendingMigrations(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to find pending migrations: %w", err)
+	}
+	if unversioned {
+		fmt.Println("Current schema version: unversioned")
+	} else {
+		fmt.Printf("Current schema version: %d\n", current)
+	}
+	fmt.Printf("Target schema version: %d\n", model.TargetSchemaVersion())
+	for _, m := range pending {
+		fmt.Printf("  pending %d: %s\n", m.Version, m.Description)
+	}
+	if status || len(pending) == 0 {
+		return nil
+	}
+	if err := model.Migrate(ctx, db); err != nil {
+		return fmt.Errorf("failed to migrate the database schema: %w", err)
+	}
+	return nil
+}
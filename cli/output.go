@@ -0,0 +1,158 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// record is an annotation as it is written out
+type record struct {
+	Id       int64          `json:"id"`
+	BookId   int64          `json:"bookId"`
+	Book     string         `json:"book"`
+	Authors  string         `json:"authors"`
+	Type     string         `json:"type"`
+	Ts       time.Time      `json:"ts"`
+	Location model.Location `json:"location"`
+	Chapter  string         `json:"chapter,omitempty"`
+	Source   string         `json:"source,omitempty"`
+	Origin   string         `json:"origin,omitempty"`
+	Text     string         `json:"text"`
+}
+
+var outputFormats = map[string]func(w io.Writer, records []record) error{
+	"table": writeTable,
+	"json":  writeJson,
+	"csv":   writeCsv,
+}
+
+// booksById maps all books, to add their name and authors to records
+func booksById(ctx context.Context, db *sql.DB) (map[int64]model.Book, error) {
+	reader, err := model.NewDBBookReader(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	books, err := reader.ListBooks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list books: %w", err)
+	}
+	byId := make(map[int64]model.Book)
+	for _, b := range books {
+		byId[b.Id] = b
+	}
+	return byId, nil
+}
+
+func newRecord(a model.Annotation, book model.Book) record {
+	return record{
+		Id:       a.Id,
+		BookId:   a.BookId,
+		Book:     book.Name,
+		Authors:  book.Authors,
+		Type:     string(a.Type),
+		Ts:       a.Ts,
+		Location: a.Location,
+		Chapter:  a.Chapter.Title,
+		Source:   a.Source,
+		Origin:   a.Origin,
+		Text:     a.Text,
+	}
+}
+
+func writeJson(w io.Writer, records []record) error {
+	if records == nil {
+		records = []record{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(records)
+}
+
+func writeCsv(w io.Writer, records []record) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"id", "book_id", "book", "authors", "type", "ts", "location", "chapter", "source", "origin", "text"})
+	for _, r := range records {
+		_ = cw.Write([]string{strconv.FormatInt(r.Id, 10), strconv.FormatInt(r.BookId, 10), r.Book, r.Authors, r.Type,
+			r.Ts.Format(time.RFC3339), describeLocation(r.Location), r.Chapter, r.Source, r.Origin, r.Text})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeTable(w io.Writer, records []record) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tBOOK\tTYPE\tTIME\tLOCATION\tTEXT")
+	for _, r := range records {
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", r.Id, shorten(r.Book, 30), r.Type, r.Ts.Format("2006-01-02 15:04"),
+			describeLocation(r.Location), shorten(r.Text, 60))
+	}
+	return tw.Flush()
+}
+
+func describeLocation(l model.Location) string {
+	describe := func(kind string, start *int, end *int) string {
+		if end != nil && *end != *start {
+			return fmt.Sprintf("%s %d-%d", kind, *start, *end)
+		}
+		return fmt.Sprintf("%s %d", kind, *start)
+	}
+	switch {
+	case l.LocationStart != nil:
+		return describe("location", l.LocationStart, l.LocationEnd)
+	case l.PageStart != nil:
+		return describe("page", l.PageStart, l.PageEnd)
+	}
+	return ""
+}
+
+func shorten(s string, max int) string {
+	runes := []rune(strings.Join(strings.Fields(s), " "))
+	if len(runes) > max {
+		return string(runes[:max-3]) + "..."
+	}
+	return string(runes)
+}
+
+// orderByChapter is not an order of the database, annotations are grouped after they are read
+const orderByChapter = "chapter"
+
+// groupByChapter keeps annotations of each book together, books in order of their first annotation,
+// and orders annotations of a book by chapter
+func groupByChapter(annotations []model.Annotation) []model.Annotation {
+	var bookIds []int64
+	byBook := make(map[int64][]model.Annotation)
+	for _, a := range annotations {
+		if _, ok := byBook[a.BookId]; !ok {
+			bookIds = append(bookIds, a.BookId)
+		}
+		byBook[a.BookId] = append(byBook[a.BookId], a)
+	}
+	grouped := make([]model.Annotation, 0, len(annotations))
+	for _, id := range bookIds {
+		for _, group := range model.GroupByChapter(byBook[id]) {
+			grouped = append(grouped, group.Annotations...)
+		}
+	}
+	return grouped
+}
+
+func parseOrder(order string) (model.AnnotationOrder, bool) {
+	switch order {
+	case "id":
+		return model.OrderById, true
+	case "location":
+		return model.OrderByLocation, true
+	case "ts":
+		return model.OrderByTimestamp, true
+	}
+	return "", false
+}
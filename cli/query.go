@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"io"
+	"os"
+	"strings"
+)
+
+var queryDescription = "Query is a list of field:value terms (all of them have to match), like\n" +
+	"  book:\"Designing Data\" type:note after:2022-01-01 tag:architecture source:oreilly -origin:old.txt replication\n" +
+	"A term prefixed with - is negated, a term without a field matches the text.\n" +
+	"Fields: " + strings.Join(model.FilterFields(), ", ")
+
+func runQuery(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("query", "[query]", queryDescription)
+	var format, order string
+	var limit int
+	var includeDeleted bool
+	fs.StringVar(&format, "format", "table", "output format: table, json or csv")
+	fs.StringVar(&order, "order", "location", "order of annotations: id, location, ts, or chapter (grouped by book and chapter)")
+	fs.IntVar(&limit, "limit", 0, "show at most this many annotations (0 for all)")
+	fs.BoolVar(&includeDeleted, "include-deleted", false, "include annotations soft-deleted by reconciliation")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	write, ok := outputFormats[format]
+	if !ok {
+		return invalidUsage(fs, "Unknown output format %q, it has to be table, json or csv", format)
+	}
+	return queryAnnotations(ctx, o, fs.Args(), order, limit, includeDeleted, os.Stdout, write)
+}
+
+// queryAnnotations writes the annotations matching the query, ordered as asked for
+func queryAnnotations(ctx context.Context, o *options, query []string, order string, limit int, includeDeleted bool,
+	w io.Writer, write func(w io.Writer, records []record) error) error {
+	filter, err := model.ParseFilter(strings.Join(query, " "))
+	if err != nil {
+		return err
+	}
+	// annotations are grouped by chapter once they are read in order of location
+	byChapter := order == orderByChapter
+	if byChapter {
+		order = "location"
+	}
+	annotationOrder, ok := parseOrder(order)
+	if !ok {
+		return fmt.Errorf("unknown order %q, it has to be id, location, ts or chapter", order)
+	}
+	pageLimit := limit
+	if byChapter {
+		pageLimit = 0
+	}
+
+	db, err := o.openExistingDatabase()
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	annotations, err := model.NewDBAnnotationReader(db)
+	if err != nil {
+		return fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	page, err := annotations.ListAnnotations(ctx, model.AnnotationQuery{
+		Filter:         filter,
+		IncludeDeleted: includeDeleted,
+		OrderBy:        annotationOrder,
+		Limit:          pageLimit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query annotations: %w", err)
+	}
+	if byChapter {
+		page.Annotations = groupByChapter(page.Annotations)
+		if limit > 0 && len(page.Annotations) > limit {
+			page.Annotations = page.Annotations[:limit]
+		}
+	}
+	books, err := booksById(ctx, db)
+	if err != nil {
+		return err
+	}
+	var records []record
+	for _, a := range page.Annotations {
+		records = append(records, newRecord(a, books[a.BookId]))
+	}
+	if err := write(w, records); err != nil {
+		return fmt.Errorf("failed to write annotations: %w", err)
+	}
+	return nil
+}
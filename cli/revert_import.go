@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+)
+
+func runRevertImport(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("revert-import", "[run-id]", "Without run-id, import runs are listed.")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return invalidUsage(fs, "At most one import run Id is expected")
+	}
+
+	db, err := o.openDatabase()
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	if err := model.Migrate(ctx, db); err != nil {
+		return fmt.Errorf("failed to migrate the database schema: %w", err)
+	}
+	reverter := model.NewDBImportReverter(db)
+
+	if fs.NArg() == 0 {
+		runs, err := reverter.ListImportRuns(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list import runs: %w", err)
+		}
+		for _, run := range runs {
+			reverted := ""
+			if !run.RevertedAt.IsZero() {
+				reverted = fmt.Sprintf(" (reverted at %s)", run.RevertedAt.Format("2006-01-02 15:04:05"))
+			}
+			fmt.Printf("#%d %s %s %s: %d inserted, %d updated, %d failed%s\n", run.Id, run.StartedAt.Format("2006-01-02 15:04:05"),
+				run.Source, run.Origin, run.Inserted, run.Updated, run.Failed, reverted)
+		}
+		return nil
+	}
+	run, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return invalidUsage(fs, "Invalid import run Id %q", fs.Arg(0))
+	}
+	result, err := reverter.RevertImportRun(ctx, run)
+	if err != nil {
+		return fmt.Errorf("failed to revert import run: %w", err)
+	}
+	log.Infof("Reverted import run #%d: deleted %d annotations and %d books, restored %d annotations and %d books",
+		run, result.DeletedAnnotations, result.DeletedBooks, result.RestoredAnnotations, result.RestoredBooks)
+	if result.Skipped > 0 {
+		log.Warnf("Left %d annotations and books as they are, since later import runs wrote them again", result.Skipped)
+	}
+	return nil
+}
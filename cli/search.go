@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func runSearch(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("search", "query", "Query matches words in the text of annotations and in the title and authors of their book;\n"+
+		"\"a phrase\", prefix* and AND, OR, NOT are supported.")
+	var book, annotationType string
+	var limit int
+	fs.StringVar(&book, "book", "", "search only annotations of the book with this Id, or whose title contains this text")
+	fs.StringVar(&annotationType, "type", "", "search only annotations of this type (highlight or note)")
+	fs.IntVar(&limit, "limit", 20, "show at most this many results (0 for all)")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return invalidUsage(fs, "Query is missing")
+	}
+	if annotationType != "" && annotationType != string(model.Highlight) && annotationType != string(model.Note) {
+		return invalidUsage(fs, "Unknown annotation type %q, it has to be highlight or note", annotationType)
+	}
+
+	db, err := o.openExistingDatabase()
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	searcher, err := model.NewDBAnnotationSearcher(db)
+	if err != nil {
+		return fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	query := model.SearchQuery{
+		Text:  strings.Join(fs.Args(), " "),
+		Type:  model.AnnotationType(annotationType),
+		Limit: limit,
+	}
+	if book != "" {
+		if query.BookId, err = findBook(ctx, db, book); err != nil {
+			return err
+		}
+	}
+	if isTerminal() {
+		query.MarkStart, query.MarkEnd = "\x1b[1m", "\x1b[0m"
+	}
+	results, err := searcher.Search(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to search: %w", err)
+	}
+	for _, r := range results {
+		a := r.Annotation
+		location := describeLocation(a.Location)
+		if location != "" {
+			location = ", " + location
+		}
+		fmt.Printf("#%d %s in %s (%s)%s\n    %s\n", a.Id, a.Type, r.Book.Name, r.Book.Authors, location,
+			strings.Join(strings.Fields(r.Snippet), " "))
+	}
+	if len(results) == 0 {
+		fmt.Println("Nothing found")
+	}
+	return nil
+}
+
+// findBook takes the Id as it is, otherwise the title has to identify a single book
+func findBook(ctx context.Context, db *sql.DB, book string) (int64, error) {
+	if id, err := strconv.ParseInt(book, 10, 64); err == nil {
+		return id, nil
+	}
+	reader, err := model.NewDBBookReader(db)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	books, err := reader.ListBooks(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list books: %w", err)
+	}
+	var found []model.Book
+	for _, b := range books {
+		if strings.Contains(strings.ToLower(b.Name), strings.ToLower(book)) {
+			found = append(found, b)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return 0, fmt.Errorf("no book title contains %q", book)
+	case 1:
+		return found[0].Id, nil
+	}
+	for _, b := range found {
+		_, _ = fmt.Fprintf(os.Stderr, "%d: %s (%s)\n", b.Id, b.Name, b.Authors)
+	}
+	return 0, fmt.Errorf("%d books match %q, use the Id of one of them", len(found), book)
+}
+
+func isTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,331 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runServe(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("serve", "", "Serves a read-only JSON API:\n"+
+		"  GET /api/books, /api/books/{id}\n"+
+		"  GET /api/annotations?q=query&order=id|location|ts&limit=n&after=cursor, /api/annotations/{id}\n"+
+		"  GET /api/search?q=text&book=id&type=highlight|note&limit=n\n"+
+		"  GET /api/stats")
+	var listen string
+	fs.StringVar(&listen, "listen", "localhost:8080", "address to listen on")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+
+	db, err := o.openExistingDatabase()
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	handler, err := newApiHandler(db)
+	if err != nil {
+		return fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	server := &http.Server{Addr: listen, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Warnf("Failed to shut down the server: %v", err)
+		}
+	}()
+	log.Infof("Serving on http://%s/api/", listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// httpError is an error with the status it is reported with
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{status: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+type apiHandler struct {
+	books       model.BookReader
+	annotations model.AnnotationReader
+	searcher    model.AnnotationSearcher
+	stats       model.StatsReader
+	mux         *http.ServeMux
+}
+
+func newApiHandler(db *sql.DB) (_ *apiHandler, err error) {
+	h := &apiHandler{mux: http.NewServeMux()}
+	if h.books, err = model.NewDBBookReader(db); err != nil {
+		return nil, err
+	}
+	if h.annotations, err = model.NewDBAnnotationReader(db); err != nil {
+		return nil, err
+	}
+	if h.searcher, err = model.NewDBAnnotationSearcher(db); err != nil {
+		return nil, err
+	}
+	if h.stats, err = model.NewDBStatsReader(db); err != nil {
+		return nil, err
+	}
+	h.mux.HandleFunc("/api/books", h.handle(h.listBooks))
+	h.mux.HandleFunc("/api/books/", h.handle(h.getBook))
+	h.mux.HandleFunc("/api/annotations", h.handle(h.listAnnotations))
+	h.mux.HandleFunc("/api/annotations/", h.handle(h.getAnnotation))
+	h.mux.HandleFunc("/api/search", h.handle(h.search))
+	h.mux.HandleFunc("/api/stats", h.handle(h.getStats))
+	return h, nil
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// handle writes what the endpoint returns as JSON, or its error with the matching status
+func (h *apiHandler) handle(endpoint func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeApiError(w, http.StatusMethodNotAllowed, errors.New("only GET is supported"))
+			return
+		}
+		response, err := endpoint(r)
+		var httpErr *httpError
+		switch {
+		case err == nil:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				log.Warnf("Failed to write the response of %v: %v", r.URL, err)
+			}
+		case errors.As(err, &httpErr):
+			writeApiError(w, httpErr.status, httpErr)
+		case errors.Is(err, model.ErrBookNotFound), errors.Is(err, model.ErrAnnotationNotFound):
+			writeApiError(w, http.StatusNotFound, err)
+		case errors.Is(err, model.ErrInvalidFilter), errors.Is(err, model.ErrInvalidCursor):
+			writeApiError(w, http.StatusBadRequest, err)
+		case errors.Is(err, model.ErrSearchUnsupported):
+			writeApiError(w, http.StatusNotImplemented, err)
+		default:
+			log.Errorf("Failed to serve %v: %v", r.URL, err)
+			writeApiError(w, http.StatusInternalServerError, errors.New("internal error"))
+		}
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+type bookResponse struct {
+	Id      int64  `json:"id"`
+	Name    string `json:"name"`
+	Authors string `json:"authors"`
+	Isbn    string `json:"isbn,omitempty"`
+}
+
+type annotationPageResponse struct {
+	Annotations []record `json:"annotations"`
+	Next        string   `json:"next,omitempty"`
+}
+
+type searchResultResponse struct {
+	Annotation record  `json:"annotation"`
+	Snippet    string  `json:"snippet"`
+	Rank       float64 `json:"rank"`
+}
+
+type statsResponse struct {
+	Books       int            `json:"books"`
+	Annotations int            `json:"annotations"`
+	Highlights  int            `json:"highlights"`
+	Notes       int            `json:"notes"`
+	BySource    map[string]int `json:"bySource"`
+	Deleted     int            `json:"deleted"`
+	ImportRuns  int            `json:"importRuns"`
+	LastImport  *time.Time     `json:"lastImport,omitempty"`
+}
+
+func (h *apiHandler) listBooks(r *http.Request) (interface{}, error) {
+	books, err := h.books.ListBooks(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	response := []bookResponse{}
+	for _, b := range books {
+		response = append(response, bookResponse{Id: b.Id, Name: b.Name, Authors: b.Authors, Isbn: b.Isbn})
+	}
+	return response, nil
+}
+
+func (h *apiHandler) getBook(r *http.Request) (interface{}, error) {
+	id, err := pathId(r, "/api/books/")
+	if err != nil {
+		return nil, err
+	}
+	b, err := h.books.GetBook(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	return bookResponse{Id: b.Id, Name: b.Name, Authors: b.Authors, Isbn: b.Isbn}, nil
+}
+
+func (h *apiHandler) listAnnotations(r *http.Request) (interface{}, error) {
+	params := r.URL.Query()
+	filter, err := model.ParseFilter(params.Get("q"))
+	if err != nil {
+		return nil, err
+	}
+	query := model.AnnotationQuery{Filter: filter, After: params.Get("after"), Limit: 100}
+	if order := params.Get("order"); order != "" {
+		var ok bool
+		if query.OrderBy, ok = parseOrder(order); !ok {
+			return nil, badRequest("unknown order %q, it has to be id, location or ts", order)
+		}
+	}
+	if query.Limit, err = intParam(r, "limit", query.Limit); err != nil {
+		return nil, err
+	}
+	if query.Limit <= 0 || query.Limit > 1000 {
+		return nil, badRequest("limit has to be between 1 and 1000")
+	}
+	page, err := h.annotations.ListAnnotations(r.Context(), query)
+	if err != nil {
+		return nil, err
+	}
+	books, err := h.booksOf(r.Context(), page.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	response := annotationPageResponse{Annotations: []record{}, Next: page.Next}
+	for _, a := range page.Annotations {
+		response.Annotations = append(response.Annotations, newRecord(a, books[a.BookId]))
+	}
+	return response, nil
+}
+
+func (h *apiHandler) getAnnotation(r *http.Request) (interface{}, error) {
+	id, err := pathId(r, "/api/annotations/")
+	if err != nil {
+		return nil, err
+	}
+	a, err := h.annotations.GetAnnotation(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	book, err := h.books.GetBook(r.Context(), a.BookId)
+	if err != nil {
+		return nil, err
+	}
+	return newRecord(*a, *book), nil
+}
+
+func (h *apiHandler) search(r *http.Request) (interface{}, error) {
+	params := r.URL.Query()
+	query := model.SearchQuery{Text: params.Get("q"), Type: model.AnnotationType(params.Get("type"))}
+	if strings.TrimSpace(query.Text) == "" {
+		return nil, badRequest("query parameter q is missing")
+	}
+	if query.Type != "" && query.Type != model.Highlight && query.Type != model.Note {
+		return nil, badRequest("unknown annotation type %q, it has to be highlight or note", query.Type)
+	}
+	var err error
+	if query.Limit, err = intParam(r, "limit", 20); err != nil {
+		return nil, err
+	}
+	bookId, err := intParam(r, "book", 0)
+	if err != nil {
+		return nil, err
+	}
+	query.BookId = int64(bookId)
+	results, err := h.searcher.Search(r.Context(), query)
+	if err != nil {
+		return nil, err
+	}
+	response := []searchResultResponse{}
+	for _, result := range results {
+		response = append(response, searchResultResponse{
+			Annotation: newRecord(result.Annotation, result.Book),
+			Snippet:    result.Snippet,
+			Rank:       result.Rank,
+		})
+	}
+	return response, nil
+}
+
+func (h *apiHandler) getStats(r *http.Request) (interface{}, error) {
+	s, err := h.stats.Stats(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	response := statsResponse{
+		Books:       s.Books,
+		Annotations: s.Annotations,
+		Highlights:  s.ByType[model.Highlight],
+		Notes:       s.ByType[model.Note],
+		BySource:    s.BySource,
+		Deleted:     s.Deleted,
+		ImportRuns:  s.ImportRuns,
+	}
+	if s.LastImport != nil {
+		response.LastImport = &s.LastImport.StartedAt
+	}
+	return response, nil
+}
+
+// booksOf reads the books of the annotations
+func (h *apiHandler) booksOf(ctx context.Context, annotations []model.Annotation) (map[int64]model.Book, error) {
+	books := make(map[int64]model.Book)
+	for _, a := range annotations {
+		if _, ok := books[a.BookId]; ok {
+			continue
+		}
+		b, err := h.books.GetBook(ctx, a.BookId)
+		if err != nil {
+			return nil, err
+		}
+		books[a.BookId] = *b
+	}
+	return books, nil
+}
+
+func pathId(r *http.Request, prefix string) (int64, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, prefix), 10, 64)
+	if err != nil {
+		return 0, &httpError{status: http.StatusNotFound, err: fmt.Errorf("invalid Id in %v", r.URL.Path)}
+	}
+	return id, nil
+}
+
+func intParam(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, badRequest("%v has to be a number", name)
+	}
+	return n, nil
+}
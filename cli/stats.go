@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"sort"
+)
+
+func runStats(ctx context.Context, args []string) error {
+	fs, o := newFlagSet("stats", "", "")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+
+	db, err := o.openExistingDatabase()
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(db)
+
+	reader, err := model.NewDBStatsReader(db)
+	if err != nil {
+		return fmt.Errorf("failed to prepare the database: %w", err)
+	}
+	s, err := reader.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Books: %d\n", s.Books)
+	fmt.Printf("Annotations: %d (%d highlights, %d notes)\n", s.Annotations, s.ByType[model.Highlight], s.ByType[model.Note])
+	var sources []string
+	for source := range s.BySource {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		name := source
+		if name == "" {
+			name = "unknown"
+		}
+		fmt.Printf("  from %s: %d\n", name, s.BySource[source])
+	}
+	if s.Deleted > 0 {
+		fmt.Printf("Soft-deleted annotations: %d\n", s.Deleted)
+	}
+	fmt.Printf("Import runs: %d\n", s.ImportRuns)
+	if run := s.LastImport; run != nil {
+		fmt.Printf("Last import: #%d %s %s %s: %d inserted, %d updated, %d failed\n", run.Id,
+			run.StartedAt.Format("2006-01-02 15:04:05"), run.Source, run.Origin, run.Inserted, run.Updated, run.Failed)
+	}
+	return nil
+}
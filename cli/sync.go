@@ -0,0 +1,214 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/config"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"github.com/milanaleksic/tt-extractor-kindle/oreilly"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"time"
+)
+
+func runSync(ctx context.Context, args []string) error {
+	fs, i := newIngestion("sync", "[source...]", "Ingests the sources of the configuration file (only the named ones, if any)\n"+
+		"and then writes its exports. A failing source is reported and the others are still ingested.")
+	if err := i.parse(fs, args); err != nil {
+		return err
+	}
+	if i.config == nil {
+		return invalidUsage(fs, "There is no configuration file, create %v or use -config", config.FileName)
+	}
+	sources, err := selectSources(i.config, fs.Args())
+	if err != nil {
+		return err
+	}
+	for _, s := range sources {
+		if err := validateSource(s); err != nil {
+			return fmt.Errorf("%w %v: %v", config.ErrInvalidConfig, i.config.Location(), err)
+		}
+	}
+	if err := i.start(ctx); err != nil {
+		return err
+	}
+	defer i.close()
+
+	failed := 0
+	for _, s := range sources {
+		log.Infof("Syncing source %v", s.Name)
+		if err := i.syncSource(ctx, s); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Errorf("Failed to sync source %v: %v", s.Name, err)
+			failed++
+		}
+	}
+	i.printChanges()
+	if i.dryRun {
+		return nil
+	}
+	failed += i.writeExports(ctx)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sources and exports failed", failed, len(sources)+len(i.config.Exports))
+	}
+	return nil
+}
+
+// writeExports writes the exports of the configuration and returns how many of them failed
+func (i *ingestion) writeExports(ctx context.Context) (failed int) {
+	for _, e := range i.config.Exports {
+		format, order := e.Format, e.Order
+		if format == "" {
+			format = "json"
+		}
+		if order == "" {
+			order = "location"
+		}
+		if err := exportAnnotations(ctx, i.options, e.Path, format, e.Query, order, e.IncludeDeleted); err != nil {
+			log.Errorf("Failed to write export %v: %v", e.Name, err)
+			failed++
+			continue
+		}
+		log.Infof("Wrote export %v to %v", e.Name, e.Path)
+	}
+	return failed
+}
+
+// selectSources returns the sources with the names, all of them if there are no names
+func selectSources(c *config.Config, names []string) ([]config.Source, error) {
+	if len(names) == 0 {
+		return c.Sources, nil
+	}
+	var selected []config.Source
+	for _, name := range names {
+		found := false
+		for _, s := range c.Sources {
+			if s.Name == name {
+				selected = append(selected, s)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("source %q is not in %v", name, c.Location())
+		}
+	}
+	return selected, nil
+}
+
+// validateSource checks the type and options of the source, which depend on the known extractors
+func validateSource(s config.Source) error {
+	switch s.Type {
+	case "", config.TypeDetect, config.TypePlugin:
+	default:
+		if _, err := extractors.New(s.Type, nil, nil, ""); err != nil {
+			return fmt.Errorf("source %q: %w", s.Name, err)
+		}
+	}
+	for option, value := range s.Options {
+		switch {
+		case s.Type == oreilly.Source && option == "reconcile":
+			if value != "list" && value != "soft-delete" {
+				return fmt.Errorf("source %q: reconcile has to be list or soft-delete, not %q", s.Name, value)
+			}
+		default:
+			return fmt.Errorf("source %q: unknown option %q", s.Name, option)
+		}
+	}
+	return nil
+}
+
+func (i *ingestion) syncSource(ctx context.Context, s config.Source) error {
+	if s.Type == config.TypePlugin {
+		return i.ingestPlugin(ctx, s.Path, s.Args, s.Origin)
+	}
+	files, err := s.Files()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, err := i.ingestSourceFile(ctx, s, file, model.Ingest); err != nil {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// ingestSourceFile ingests one of the files of the source, detecting its format if the source has no type, and
+// reconciles it if the source says so; the run is nil if the file was skipped
+func (i *ingestion) ingestSourceFile(ctx context.Context, s config.Source, file string, ingest ingestFunc) (*model.ImportRun, error) {
+	origin := s.OriginOf(file)
+	reconcile := s.Options["reconcile"]
+	if reconcile != "" {
+		// every file is a complete export, so only the newest one tells what is still there
+		files, err := s.Files()
+		if err != nil {
+			return nil, err
+		}
+		newest, err := newestFile(files)
+		if err != nil {
+			return nil, err
+		}
+		if newest != file {
+			log.Infof("Skipping %v of source %v, %v is a newer export", file, s.Name, newest)
+			return nil, nil
+		}
+	}
+	books, annotations := i.repositories()
+	var run *model.ImportRun
+	err := ingestFile(file, func(f *os.File) error {
+		source := s.Type
+		if source == "" || source == config.TypeDetect {
+			var err error
+			if source, _, err = extractors.DetectInput(f); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		extractor, err := extractors.New(source, books, annotations, origin)
+		if err != nil {
+			return err
+		}
+		runSource, err := importRunSource(source, f)
+		if err != nil {
+			return err
+		}
+		run = &model.ImportRun{Source: runSource, Origin: origin, Account: s.Account()}
+		if reconcile != "" {
+			// reconciliation needs the whole snapshot
+			ingest = model.Ingest
+		}
+		if err := i.ingestWith(ctx, ingest, extractor, run, f); err != nil {
+			return err
+		}
+		if reconcile != "" {
+			if i.dryRun {
+				log.Warnf("Source %v is not reconciled on a dry run", s.Name)
+				return nil
+			}
+			return reconcileRun(ctx, i.db, run, reconcile == "soft-delete")
+		}
+		return nil
+	})
+	return run, err
+}
+
+// newestFile is the file modified last, or the last of them by name if they were modified at the same time
+func newestFile(files []string) (string, error) {
+	var newest string
+	var newestModTime time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		if newest == "" || !info.ModTime().Before(newestModTime) {
+			newest, newestModTime = file, info.ModTime()
+		}
+	}
+	return newest, nil
+}
@@ -0,0 +1,170 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/config"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+func runWatch(ctx context.Context, args []string) error {
+	fs, i := newIngestion("watch", "[source...]", "Watches the files of the sources of the configuration file (only the named ones, if any),\n"+
+		"like a mounted Kindle or a folder of downloaded O'Reilly exports. A file which appears or changes is ingested\n"+
+		"once it stays unchanged for the debounce period; records ingested before are skipped if the file was only\n"+
+		"appended to. Exports are written after each ingestion.")
+	var interval, debounce time.Duration
+	fs.DurationVar(&interval, "interval", 2*time.Second, "how often the files are checked")
+	fs.DurationVar(&debounce, "debounce", 5*time.Second, "how long a file has to stay unchanged before it is ingested")
+	if err := i.parse(fs, args); err != nil {
+		return err
+	}
+	if i.config == nil {
+		return invalidUsage(fs, "There is no configuration file, create %v or use -config", config.FileName)
+	}
+	if i.dryRun {
+		return invalidUsage(fs, "Watching can't be combined with -dry-run")
+	}
+	if interval <= 0 || debounce < 0 {
+		return invalidUsage(fs, "Interval has to be positive and debounce can't be negative")
+	}
+	sources, err := selectSources(i.config, fs.Args())
+	if err != nil {
+		return err
+	}
+	w := &watcher{ingestion: i, debounce: debounce, files: make(map[string]*watchedFile)}
+	for _, s := range sources {
+		if err := validateSource(s); err != nil {
+			return fmt.Errorf("%w %v: %v", config.ErrInvalidConfig, i.config.Location(), err)
+		}
+		if s.Type == config.TypePlugin {
+			log.Warnf("Source %v is a plugin, it is not watched (use tt sync)", s.Name)
+			continue
+		}
+		w.sources = append(w.sources, s)
+	}
+	if len(w.sources) == 0 {
+		return errors.New("there are no sources to watch")
+	}
+	if err := i.start(ctx); err != nil {
+		return err
+	}
+	defer i.close()
+
+	log.Infof("Watching %d sources every %v, press Ctrl+C to stop", len(w.sources), interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.poll()
+		if w.ingestDue(ctx) > 0 && ctx.Err() == nil {
+			i.writeExports(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			log.Infof("Stopped watching")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// fileState tells whether a file changed
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+type watchedFile struct {
+	source config.Source
+	// seen is the state at the last check, changedAt is when it was seen to change
+	seen      fileState
+	changedAt time.Time
+	missing   bool
+	// ingested is the state which was ingested last, zero if the file was not ingested yet
+	ingested fileState
+}
+
+type watcher struct {
+	*ingestion
+	sources  []config.Source
+	debounce time.Duration
+	files    map[string]*watchedFile
+}
+
+// poll checks the files of all sources; a file matching several sources belongs to the first of them
+func (w *watcher) poll() {
+	now := time.Now()
+	present := make(map[string]bool)
+	for _, s := range w.sources {
+		files, err := filepath.Glob(s.Path)
+		if err != nil {
+			log.Errorf("Failed to list files of source %v: %v", s.Name, err)
+			continue
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil || info.IsDir() || present[file] {
+				continue
+			}
+			present[file] = true
+			state := fileState{size: info.Size(), modTime: info.ModTime()}
+			f, ok := w.files[file]
+			switch {
+			case !ok:
+				// a file which did not change for a while when it was found can be ingested right away
+				changedAt := info.ModTime()
+				if changedAt.After(now) {
+					changedAt = now
+				}
+				w.files[file] = &watchedFile{source: s, seen: state, changedAt: changedAt}
+				log.Debugf("Found %v of source %v", file, s.Name)
+			case f.missing || f.seen != state:
+				f.seen, f.changedAt, f.missing = state, now, false
+				log.Debugf("%v of source %v changed", file, s.Name)
+			}
+		}
+	}
+	for file, f := range w.files {
+		if !present[file] && !f.missing {
+			f.missing = true
+			log.Debugf("%v of source %v is gone", file, f.source.Name)
+		}
+	}
+}
+
+// ingestDue ingests the files which changed and then stayed unchanged for the debounce period, returning how many
+// of them were ingested
+func (w *watcher) ingestDue(ctx context.Context) (ingested int) {
+	var due []string
+	for file, f := range w.files {
+		if !f.missing && f.seen != f.ingested && time.Since(f.changedAt) >= w.debounce {
+			due = append(due, file)
+		}
+	}
+	sort.Strings(due)
+	for _, file := range due {
+		if ctx.Err() != nil {
+			return ingested
+		}
+		f := w.files[file]
+		run, err := w.ingestSourceFile(ctx, f.source, file, model.IngestIncrementally)
+		// a file which failed is tried again only once it changes
+		f.ingested = f.seen
+		if err != nil {
+			log.Errorf("Failed to ingest %v of source %v: %v", file, f.source.Name, err)
+			continue
+		}
+		if run == nil {
+			continue
+		}
+		ingested++
+		log.Infof("Ingested %v of source %v in %v: %d inserted, %d updated, %d failed", file, f.source.Name,
+			run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond), run.Inserted, run.Updated, run.Failed)
+	}
+	return ingested
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/milanaleksic/tt-extractor-kindle/cli"
+	"os"
+)
+
+func main() {
+	os.Exit(cli.Main(os.Args[1:]))
+}
@@ -0,0 +1,191 @@
+// Package config reads the configuration file of tt: the database, merge policies, sources to ingest and export targets
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileName is the name of the configuration file looked up in the current directory and in the user's config directory
+const FileName = "tt.yaml"
+
+// TypeDetect and TypePlugin are source types besides the names of extractors
+const (
+	TypeDetect = "detect"
+	TypePlugin = "plugin"
+)
+
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+type Config struct {
+	// Database is an SQLite3 database location or a PostgreSQL DSN
+	Database string `yaml:"database"`
+	// MergePolicies are [source:]field=policy entries, as with the -merge-policy flag
+	MergePolicies []string `yaml:"merge-policies"`
+	Sources       []Source `yaml:"sources"`
+	Exports       []Export `yaml:"exports"`
+	// location is the file the configuration was read from
+	location string
+}
+
+// Source is an input which tt sync ingests
+type Source struct {
+	Name string `yaml:"name"`
+	// Type is the name of an extractor (kindle, oreilly...), TypeDetect to detect the format of each file or TypePlugin
+	Type string `yaml:"type"`
+	// Path is a file or a glob of files; for plugins it is the command
+	Path string `yaml:"path"`
+	// Args are arguments of the plugin command
+	Args []string `yaml:"args"`
+	// Origin labels the input instead of the path of the file
+	Origin string `yaml:"origin"`
+	// Options are specific to the type, like reconcile of oreilly
+	Options map[string]string `yaml:"options"`
+}
+
+// Export is a file tt sync writes annotations to
+type Export struct {
+	Name   string `yaml:"name"`
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"`
+	// Query selects annotations using the query language, all of them if empty
+	Query          string `yaml:"query"`
+	Order          string `yaml:"order"`
+	IncludeDeleted bool   `yaml:"include-deleted"`
+}
+
+// Find returns the location of the configuration file: the one in the current directory, otherwise the one in
+// the user's config directory; empty if there is none
+func Find() string {
+	candidates := []string{FileName}
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "tt", FileName))
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// Load reads and validates the configuration; relative paths in it are relative to the file
+func Load(location string) (*Config, error) {
+	content, err := os.ReadFile(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %w", err)
+	}
+	c := &Config{location: location}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	// an empty file is a valid configuration
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w %v: %v", ErrInvalidConfig, location, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%w %v: %v", ErrInvalidConfig, location, err)
+	}
+	dir := filepath.Dir(location)
+	if c.Database != "" && !strings.Contains(c.Database, "://") {
+		c.Database = resolve(dir, c.Database)
+	}
+	for i := range c.Sources {
+		s := &c.Sources[i]
+		// plugin commands without a path are looked up in PATH
+		if s.Type != TypePlugin || strings.ContainsRune(s.Path, filepath.Separator) {
+			s.Path = resolve(dir, s.Path)
+		}
+	}
+	for i := range c.Exports {
+		c.Exports[i].Path = resolve(dir, c.Exports[i].Path)
+	}
+	return c, nil
+}
+
+func (c *Config) Location() string {
+	return c.location
+}
+
+func (c *Config) validate() error {
+	names := make(map[string]bool)
+	for i, s := range c.Sources {
+		switch {
+		case s.Name == "":
+			return fmt.Errorf("source %d has no name", i+1)
+		case names[s.Name]:
+			return fmt.Errorf("source %q is configured more than once", s.Name)
+		case s.Path == "":
+			return fmt.Errorf("source %q has no path", s.Name)
+		case len(s.Args) > 0 && s.Type != TypePlugin:
+			return fmt.Errorf("source %q has args, but only plugins take them", s.Name)
+		}
+		names[s.Name] = true
+	}
+	exports := make(map[string]bool)
+	for i, e := range c.Exports {
+		switch {
+		case e.Name == "":
+			return fmt.Errorf("export %d has no name", i+1)
+		case exports[e.Name]:
+			return fmt.Errorf("export %q is configured more than once", e.Name)
+		case e.Path == "":
+			return fmt.Errorf("export %q has no path", e.Name)
+		case e.Format != "" && e.Format != "json" && e.Format != "csv":
+			return fmt.Errorf("export %q has unknown format %q, it has to be json or csv", e.Name, e.Format)
+		}
+		exports[e.Name] = true
+	}
+	return nil
+}
+
+// Files are the files matching the path of the source, sorted
+func (s Source) Files() ([]string, error) {
+	files, err := filepath.Glob(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("source %q: %w", s.Name, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("source %q: no file matches %v", s.Name, s.Path)
+	}
+	return files, nil
+}
+
+// OriginOf the file of the source: its path, or the origin label (followed by the file name if the path is
+// a glob, so that each of the files keeps its own origin)
+func (s Source) OriginOf(file string) string {
+	switch {
+	case s.Origin == "":
+		return file
+	case strings.ContainsAny(s.Path, `*?[\`):
+		return s.Origin + ":" + filepath.Base(file)
+	}
+	return s.Origin
+}
+
+// Account labels the complete snapshots of the source (see reconcile of oreilly): the origin label or the name of
+// the source, so that an export saved under a new file name is still compared with the earlier ones
+func (s Source) Account() string {
+	if s.Origin != "" {
+		return s.Origin
+	}
+	return s.Name
+}
+
+// resolve expands ~ and makes the path relative to dir
+func resolve(dir string, path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,96 @@
+package isbn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidLength    = errors.New("ISBN must have 10 or 13 digits")
+	ErrInvalidCharacter = errors.New("ISBN contains invalid character")
+	ErrInvalidChecksum  = errors.New("ISBN checksum does not match")
+)
+
+// Normalize validates ISBN-10 or ISBN-13 (hyphens and spaces are allowed) and returns it as canonical ISBN-13
+func Normalize(s string) (string, error) {
+	digits := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(s)))
+	switch len(digits) {
+	case 10:
+		if err := validate10(digits); err != nil {
+			return "", fmt.Errorf("invalid ISBN %q: %w", s, err)
+		}
+		isbn13 := "978" + digits[:9]
+		return isbn13 + string(checkDigit13(isbn13)), nil
+	case 13:
+		if err := validate13(digits); err != nil {
+			return "", fmt.Errorf("invalid ISBN %q: %w", s, err)
+		}
+		return digits, nil
+	default:
+		return "", fmt.Errorf("invalid ISBN %q: %w", s, ErrInvalidLength)
+	}
+}
+
+// IsValid tells if the value is a valid ISBN-10 or ISBN-13
+func IsValid(s string) bool {
+	_, err := Normalize(s)
+	return err == nil
+}
+
+// To10 converts a canonical ISBN-13 into ISBN-10, which exists only for the 978 prefix
+func To10(isbn13 string) (string, bool) {
+	if len(isbn13) != 13 || !strings.HasPrefix(isbn13, "978") {
+		return "", false
+	}
+	isbn10 := isbn13[3:12]
+	return isbn10 + string(checkDigit10(isbn10)), true
+}
+
+func validate10(digits string) error {
+	for i, c := range digits {
+		if (c < '0' || c > '9') && !(c == 'X' && i == 9) {
+			return ErrInvalidCharacter
+		}
+	}
+	if checkDigit10(digits[:9]) != rune(digits[9]) {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+func validate13(digits string) error {
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return ErrInvalidCharacter
+		}
+	}
+	if checkDigit13(digits[:12]) != rune(digits[12]) {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+func checkDigit10(first9 string) rune {
+	sum := 0
+	for i, c := range first9[:9] {
+		sum += (10 - i) * int(c-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return rune('0' + check)
+}
+
+func checkDigit13(first12 string) rune {
+	sum := 0
+	for i, c := range first12[:12] {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(c-'0')
+	}
+	return rune('0' + (10-sum%10)%10)
+}
@@ -0,0 +1,65 @@
+package isbn
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		err   error
+	}{
+		{input: "0-306-40615-2", want: "9780306406157"},
+		{input: "978-0-306-40615-7", want: "9780306406157"},
+		{input: " 978 0306406157 ", want: "9780306406157"},
+		{input: "080442957X", want: "9780804429573"},
+		{input: "080442957x", want: "9780804429573"},
+		{input: "979-10-90636-07-1", want: "9791090636071"},
+		{input: "0306406153", err: ErrInvalidChecksum},
+		{input: "9780306406158", err: ErrInvalidChecksum},
+		{input: "03064O6152", err: ErrInvalidCharacter},
+		{input: "0X06406152", err: ErrInvalidCharacter},
+		{input: "978030640615X", err: ErrInvalidCharacter},
+		{input: "12345", err: ErrInvalidLength},
+		{input: "", err: ErrInvalidLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := Normalize(tt.input)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Normalize(%q) error = %v, expected %v", tt.input, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("Normalize(%q) = %q, expected %q", tt.input, got, tt.want)
+			}
+			if IsValid(tt.input) != (tt.err == nil) {
+				t.Errorf("IsValid(%q) = %v, expected %v", tt.input, !(tt.err == nil), tt.err == nil)
+			}
+		})
+	}
+}
+
+func TestTo10(t *testing.T) {
+	tests := []struct {
+		isbn13 string
+		want   string
+		ok     bool
+	}{
+		{isbn13: "9780306406157", want: "0306406152", ok: true},
+		{isbn13: "9780804429573", want: "080442957X", ok: true},
+		// 979 ISBNs have no ISBN-10
+		{isbn13: "9791090636071"},
+		{isbn13: "0306406152"},
+		{isbn13: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.isbn13, func(t *testing.T) {
+			got, ok := To10(tt.isbn13)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("To10(%q) = %q, %v, expected %q, %v", tt.isbn13, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -10,8 +10,11 @@ import (
 	"regexp"
 	"strings"
 	"time"
+	"unicode"
 )
 
+const Source = "kindle"
+
 var (
 	bookMetadataRegex       = regexp.MustCompile(`\(([^\)]+)\)`)
 	annotationMetadataRegex = regexp.MustCompile(`- (?:Your )?(Note|Highlight) (?:(?:Loc.|on Page|on page) (\d+)(?: |-(\d+) )\| )?(?:(?:Location|(?:at )?location) (\d+)(?:-(\d+))? \| )?Added on (.*)`)
@@ -21,6 +24,8 @@ var (
 		"Monday, 2 January 06 15:04:05",
 		"Monday, 2 January 2006 15:04:05",
 	}
+	// clippingMetadataRegex matches the line which follows the title in every clipping
+	clippingMetadataRegex = regexp.MustCompile(`^- (?:Your )?(?:Note|Highlight|Bookmark)\b`)
 )
 
 type ContentExtractor struct {
@@ -29,6 +34,7 @@ type ContentExtractor struct {
 	annotationsUpdated  int
 	annotationsInserted int
 	origin              string
+	progress            *model.Progress[string]
 }
 
 func NewContentExtractor(bookRepo model.BookRepository, annotationRepo model.AnnotationRepository, origin string) *ContentExtractor {
@@ -36,27 +42,74 @@ func NewContentExtractor(bookRepo model.BookRepository, annotationRepo model.Ann
 		bookRepo:       model.NewCachedBookRepository(bookRepo),
 		annotationRepo: annotationRepo,
 		origin:         origin,
+		progress:       model.NewProgress[string](nil),
 	}
 }
+
+func (e *ContentExtractor) Name() string {
+	return Source
+}
+
+// Detect recognizes clippings by the metadata line of the first clipping
+func (e *ContentExtractor) Detect(head []byte) bool {
+	text := strings.TrimLeftFunc(strings.TrimPrefix(string(head), "\uFEFF"), unicode.IsSpace)
+	lines := strings.SplitN(text, "\n", 3)
+	return len(lines) >= 2 && clippingMetadataRegex.MatchString(strings.TrimSpace(lines[1]))
+}
+
+func (e *ContentExtractor) ResumeFrom(c *model.Checkpoint) {
+	e.progress = model.NewProgress[string](c)
+}
+
+func (e *ContentExtractor) Checkpoint() model.Checkpoint {
+	return e.progress.Checkpoint()
+}
+
 func (e *ContentExtractor) IngestRecords(ctx context.Context, reader io.Reader) (err error) {
 	begin := time.Now()
 	scanner := configureScanner(reader)
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return e.interrupted(err)
+		}
 		l := scanner.Text()
-		log.Debugf("Encountered line ", l)
-		err := e.ingestAnnotation(ctx, l, e.origin)
-		if err != nil {
+		log.Debugf("Encountered line %v", l)
+		if err := e.ingestAnnotations(ctx, e.progress.Track(l, l)); err != nil {
 			return err
 		}
 	}
 	if err := scanner.Err(); err != nil {
 		return err
 	}
+	if err := e.ingestAnnotations(ctx, e.progress.Flush()); err != nil {
+		return err
+	}
 	log.Infof("Ingestion completed from origin %v in %dms; updated %v annotations and created %v new ones",
 		e.origin, time.Now().Sub(begin).Milliseconds(), e.annotationsUpdated, e.annotationsInserted)
 	return nil
 }
 
+func (e *ContentExtractor) ingestAnnotations(ctx context.Context, annotations []string) error {
+	for _, annotation := range annotations {
+		err := e.ingestAnnotation(ctx, annotation, e.origin)
+		// annotation might not have been stored if cancellation interrupted it
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return e.interrupted(ctxErr)
+		}
+		if err != nil {
+			return err
+		}
+		e.progress.Done()
+	}
+	return nil
+}
+
+func (e *ContentExtractor) interrupted(err error) error {
+	log.Warnf("Ingestion from origin %v interrupted after %d records; updated %v annotations and created %v new ones",
+		e.origin, e.progress.Records(), e.annotationsUpdated, e.annotationsInserted)
+	return err
+}
+
 func (e *ContentExtractor) ingestAnnotation(ctx context.Context, annotation string, origin string) error {
 	rows := strings.Split(annotation, "\n")
 	if len(rows) == 2 {
@@ -77,7 +130,10 @@ func (e *ContentExtractor) ingestAnnotation(ctx context.Context, annotation stri
 }
 
 func (e *ContentExtractor) processAnnotation(ctx context.Context, bookMetadata string, annotationMetadata string, annotationData []string, origin string) error {
-	bookId := e.getBookId(ctx, bookMetadata)
+	bookId, err := e.getBookId(ctx, bookMetadata)
+	if err != nil {
+		return err
+	}
 	annotationMetadataParsed := annotationMetadataRegex.FindAllStringSubmatch(annotationMetadata, -1)
 	if len(annotationMetadataParsed) == 0 {
 		return fmt.Errorf("Failed to match annotation regex in: %v", annotationMetadata)
@@ -104,7 +160,6 @@ func (e *ContentExtractor) processAnnotation(ctx context.Context, bookMetadata s
 	timeMatch := strings.TrimSpace(matched[field])
 	field++
 	var parsedTime time.Time
-	var err error
 	for _, layout := range layouts {
 		t, err := time.Parse(layout, timeMatch)
 		if err == nil {
@@ -123,11 +178,11 @@ func (e *ContentExtractor) processAnnotation(ctx context.Context, bookMetadata s
 		Ts:       parsedTime,
 		Origin:   origin,
 		Type:     type_,
+		Source:   Source,
 	}
 	existed, err := e.annotationRepo.UpsertAnnotation(ctx, &annotation)
 	if err != nil {
-		log.Errorf("Failed to upsert an annotation: %v", err)
-		return nil
+		return fmt.Errorf("failed to upsert an annotation: %w", err)
 	}
 	if existed {
 		e.annotationsUpdated++
@@ -137,7 +192,7 @@ func (e *ContentExtractor) processAnnotation(ctx context.Context, bookMetadata s
 	return nil
 }
 
-func (e *ContentExtractor) getBookId(ctx context.Context, bookMetadata string) (bookId int64) {
+func (e *ContentExtractor) getBookId(ctx context.Context, bookMetadata string) (bookId int64, err error) {
 	parenthesesBlocks := bookMetadataRegex.FindAllStringSubmatch(bookMetadata, -1)
 	author := ""
 	bookName := bookMetadata
@@ -149,11 +204,10 @@ func (e *ContentExtractor) getBookId(ctx context.Context, bookMetadata string) (
 	book := &model.Book{
 		Name:    bookName,
 		Authors: author,
+		Source:  Source,
 	}
-	_, err := e.bookRepo.UpsertBook(ctx, book)
-	if err != nil {
-		log.Errorf("Failed to upsert a book: %v", err)
-		return
+	if _, err := e.bookRepo.UpsertBook(ctx, book); err != nil {
+		return 0, fmt.Errorf("failed to upsert a book: %w", err)
 	}
-	return book.Id
+	return book.Id, nil
 }
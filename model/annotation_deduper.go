@@ -0,0 +1,177 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+type AnnotationDeduper interface {
+	// FindDuplicateAnnotations returns groups of annotations of the same book whose normalized texts are at least
+	// threshold (0..1) similar; first annotation in a group survives the merge
+	FindDuplicateAnnotations(ctx context.Context, threshold float64) (groups [][]Annotation, err error)
+	// MergeAnnotations completes the survivor with the data of duplicates and deletes the duplicates
+	MergeAnnotations(ctx context.Context, survivor *Annotation, duplicates []Annotation) error
+}
+
+type annotationDeduper struct {
+	db *sql.DB
+}
+
+func NewDBAnnotationDeduper(db *sql.DB) AnnotationDeduper {
+	return &annotationDeduper{
+		db: db,
+	}
+}
+
+func (d *annotationDeduper) FindDuplicateAnnotations(ctx context.Context, threshold float64) (groups [][]Annotation, err error) {
+	// soft-deleted annotations are gone from their source, so they are neither merged nor kept
+	annotations, err := listAnnotations(ctx, bind(d.db, dialectOf(d.db)), false)
+	if err != nil {
+		return nil, err
+	}
+	var bookAnnotations []Annotation
+	for i, a := range annotations {
+		bookAnnotations = append(bookAnnotations, a)
+		if i == len(annotations)-1 || annotations[i+1].BookId != a.BookId {
+			groups = append(groups, groupSimilar(bookAnnotations, threshold)...)
+			bookAnnotations = nil
+		}
+	}
+	return groups, nil
+}
+
+func groupSimilar(annotations []Annotation, threshold float64) (groups [][]Annotation) {
+	normalized := make([]string, len(annotations))
+	for i, a := range annotations {
+		normalized[i] = NormalizeText(a.Text)
+	}
+	grouped := make([]bool, len(annotations))
+	for i := range annotations {
+		if grouped[i] {
+			continue
+		}
+		group := []Annotation{annotations[i]}
+		for j := i + 1; j < len(annotations); j++ {
+			if grouped[j] || !canMerge(group, annotations[j]) || !similarEnough(normalized[i], normalized[j], threshold) {
+				continue
+			}
+			grouped[j] = true
+			group = append(group, annotations[j])
+		}
+		if len(group) > 1 {
+			// annotation known to the source is the one which will keep being updated
+			for k, a := range group {
+				if a.ExternalId != "" {
+					group[0], group[k] = group[k], group[0]
+					break
+				}
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// canMerge tells if the annotation can be merged with all annotations of the group: a highlight is never the same as
+// a note, and annotations the same source identifies differently are different, even with the same text
+func canMerge(group []Annotation, a Annotation) bool {
+	for _, member := range group {
+		if member.Type != a.Type {
+			return false
+		}
+		if member.Source == a.Source && member.ExternalId != "" && a.ExternalId != "" && member.ExternalId != a.ExternalId {
+			return false
+		}
+	}
+	return true
+}
+
+func similarEnough(a string, b string, threshold float64) bool {
+	if a == b {
+		return true
+	}
+	// similarity can't be higher than the ratio of lengths, which is much cheaper to check
+	la, lb := len([]rune(a)), len([]rune(b))
+	if la > lb {
+		la, lb = lb, la
+	}
+	if lb == 0 || float64(la)/float64(lb) < threshold {
+		return false
+	}
+	return Similarity(a, b) >= threshold
+}
+
+func (d *annotationDeduper) MergeAnnotations(ctx context.Context, survivor *Annotation, duplicates []Annotation) error {
+	return inTransaction(ctx, d.db, func(tx querier) error {
+		for _, duplicate := range duplicates {
+			if duplicate.Id == survivor.Id {
+				continue
+			}
+			if !canMerge([]Annotation{*survivor}, duplicate) {
+				return fmt.Errorf("refusing to merge annotation %v into annotation %v, they are of different types or sources identify them differently",
+					duplicate.Id, survivor.Id)
+			}
+			if survivor.Location.IsEmpty() {
+				survivor.Location = duplicate.Location
+			}
+			if survivor.Chapter.IsEmpty() {
+				survivor.Chapter = duplicate.Chapter
+			}
+			if survivor.ExternalId == "" && duplicate.ExternalId != "" {
+				survivor.Source = duplicate.Source
+				survivor.ExternalId = duplicate.ExternalId
+			}
+			if survivor.Ts.IsZero() || (!duplicate.Ts.IsZero() && duplicate.Ts.Before(survivor.Ts)) {
+				survivor.Ts = duplicate.Ts
+			}
+			if err := deleteAnnotation(ctx, tx, duplicate.Id, fmt.Sprintf("dedupe into #%d", survivor.Id)); err != nil {
+				return fmt.Errorf("failed to delete duplicate annotation %v: %w", duplicate.Id, err)
+			}
+			log.Debugf("Merged annotation %v into annotation %v", duplicate.Id, survivor.Id)
+		}
+		locationAsString, err := json.Marshal(survivor.Location)
+		if err != nil {
+			return fmt.Errorf("could not serialize into JSON %+v: %w", survivor.Location, err)
+		}
+		_, err = tx.ExecContext(ctx, "update annotation set location=?, ts=?, chapter_title=?, chapter_url=?, chapter_ordinal=?, source=?, external_id=?, fingerprint=?, change_cause=? where Id=?",
+			string(locationAsString), survivor.Ts, survivor.Chapter.Title, survivor.Chapter.Url, survivor.Chapter.Ordinal,
+			survivor.Source, nullIfEmpty(survivor.ExternalId), Fingerprint(survivor.Text), "dedupe", survivor.Id)
+		if err != nil {
+			return fmt.Errorf("failed to update merged annotation %v: %w", survivor.Id, err)
+		}
+		return nil
+	})
+}
+
+func listAnnotations(ctx context.Context, q querier, includeDeleted bool) (annotations []Annotation, err error) {
+	query := "select " + annotationColumns + " from annotation"
+	if !includeDeleted {
+		query += " where deleted_at is null"
+	}
+	rows, err := q.QueryContext(ctx, query+" order by book_id, Id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to run the query listAnnotations: %w", err)
+	}
+	defer utils.SafeClose(rows, &err)
+	for rows.Next() {
+		a, err := scanAnnotationRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, *a)
+	}
+	return annotations, rows.Err()
+}
+
+// deleteAnnotation deletes the annotation, recording the cause of deletion in its history
+func deleteAnnotation(ctx context.Context, q querier, id int64, cause string) error {
+	if _, err := q.ExecContext(ctx, "update annotation set change_cause=? where Id=?", cause, id); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx, "delete from annotation where Id=?", id)
+	return err
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestFindDuplicateAnnotationsSkipsSoftDeleted(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		annotations := testAnnotations(3, 1)
+		for i := range annotations {
+			annotations[i].Text = "The same highlight, made at three places of the book."
+		}
+		writeAnnotations(t, db, startTestRun(t, db, "test"), 0, annotations)
+		// the oldest of them, which would be kept, is no longer at its source
+		_, err := bind(db, dialectOf(db)).ExecContext(ctx, "update annotation set deleted_at=? where Id=(select min(Id) from annotation)",
+			time.Now().UTC())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		groups, err := NewDBAnnotationDeduper(db).FindDuplicateAnnotations(ctx, 0.9)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != 1 || len(groups[0]) != 2 {
+			t.Fatalf("expected a group of the 2 annotations which were not deleted, got %+v", groups)
+		}
+		for _, a := range groups[0] {
+			if !a.DeletedAt.IsZero() {
+				t.Errorf("expected soft-deleted annotation %v not to be grouped", a.Id)
+			}
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	"strings"
+	"time"
+)
+
+// annotationHistoryFields are the annotation columns whose changes are recorded; triggers created by a released
+// migration keep the columns they were created with, so a new column means a new list and a new migration
+var (
+	annotationHistoryFields = []string{
+		"book_id", "text", "location", "ts", "origin", "type", "chapter_title", "chapter_url", "chapter_ordinal", "source", "external_id",
+	}
+	annotationHistoryFieldsWithDeletion = append(annotationHistoryFields[:len(annotationHistoryFields):len(annotationHistoryFields)], "deleted_at")
+)
+
+// history entries for creation and deletion of an annotation use these instead of a column name
+const (
+	HistoryCreated = "created"
+	HistoryDeleted = "deleted"
+)
+
+// HistoryEntry is a single change of a single field of an annotation
+type HistoryEntry struct {
+	AnnotationId int64
+	ChangedAt    time.Time
+	// Cause tells which write made the change, like "import run #3" or "dedupe"
+	Cause string
+	// Field is the changed column, HistoryCreated or HistoryDeleted
+	Field    string
+	OldValue string
+	NewValue string
+}
+
+type AnnotationHistory interface {
+	// ListAnnotationHistory returns the changes of an annotation, the oldest first
+	ListAnnotationHistory(ctx context.Context, annotationId int64) ([]HistoryEntry, error)
+}
+
+type annotationHistory struct {
+	db querier
+}
+
+func NewDBAnnotationHistory(db *sql.DB) AnnotationHistory {
+	return &annotationHistory{
+		db: bind(db, dialectOf(db)),
+	}
+}
+
+func (h *annotationHistory) ListAnnotationHistory(ctx context.Context, annotationId int64) (entries []HistoryEntry, err error) {
+	rows, err := h.db.QueryContext(ctx, `
+	select annotation_id, changed_at, coalesce(cause, ''), field, coalesce(old_value, ''), coalesce(new_value, '')
+	from annotation_history where annotation_id=? order by Id`, annotationId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list history of annotation %v: %w", annotationId, err)
+	}
+	defer utils.SafeClose(rows, &err)
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.AnnotationId, &e.ChangedAt, &e.Cause, &e.Field, &e.OldValue, &e.NewValue); err != nil {
+			return nil, fmt.Errorf("failed to scan history of annotation %v: %w", annotationId, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// upsertCause is the cause of changes made by upserting an annotation
+func upsertCause(run int64) string {
+	if run == 0 {
+		return "upsert"
+	}
+	return fmt.Sprintf("import run #%d", run)
+}
+
+func sqliteAnnotationHistoryTriggers(fields []string) string {
+	var changes []string
+	for _, f := range fields {
+		changes = append(changes, fmt.Sprintf(
+			"select '%[1]s' as field, cast(old.%[1]s as text) as old_value, cast(new.%[1]s as text) as new_value where cast(old.%[1]s as text) is not cast(new.%[1]s as text)", f))
+	}
+	return `
+	create trigger if not exists annotation_history_insert after insert on annotation
+	begin
+		insert into annotation_history(annotation_id, changed_at, cause, field, old_value, new_value)
+		values (new.Id, strftime('%Y-%m-%d %H:%M:%f', 'now'), new.change_cause, '` + HistoryCreated + `', null, new.text);
+	end;
+	create trigger if not exists annotation_history_update after update on annotation
+	begin
+		insert into annotation_history(annotation_id, changed_at, cause, field, old_value, new_value)
+		select new.Id, strftime('%Y-%m-%d %H:%M:%f', 'now'), new.change_cause, field, old_value, new_value from (
+			` + strings.Join(changes, "\n\t\t\tunion all ") + `
+		);
+	end;
+	create trigger if not exists annotation_history_delete after delete on annotation
+	begin
+		insert into annotation_history(annotation_id, changed_at, cause, field, old_value, new_value)
+		values (old.Id, strftime('%Y-%m-%d %H:%M:%f', 'now'), old.change_cause, '` + HistoryDeleted + `', old.text, null);
+	end;
+	`
+}
+
+func postgresAnnotationHistoryTriggers(fields []string) string {
+	var changes []string
+	for _, f := range fields {
+		changes = append(changes, fmt.Sprintf(`
+			if old.%[1]s is distinct from new.%[1]s then
+				insert into annotation_history(annotation_id, changed_at, cause, field, old_value, new_value)
+				values (new.Id, now(), new.change_cause, '%[1]s', old.%[1]s::text, new.%[1]s::text);
+			end if;`, f))
+	}
+	return `
+	create or replace function record_annotation_history() returns trigger as $$
+	begin
+		if tg_op = 'INSERT' then
+			insert into annotation_history(annotation_id, changed_at, cause, field, old_value, new_value)
+			values (new.Id, now(), new.change_cause, '` + HistoryCreated + `', null, new.text);
+		elsif tg_op = 'DELETE' then
+			insert into annotation_history(annotation_id, changed_at, cause, field, old_value, new_value)
+			values (old.Id, now(), old.change_cause, '` + HistoryDeleted + `', old.text, null);
+			return old;
+		else` + strings.Join(changes, "") + `
+		end if;
+		return new;
+	end
+	$$ language plpgsql;
+	drop trigger if exists annotation_history on annotation;
+	create trigger annotation_history after insert or update or delete on annotation
+		for each row execute procedure record_annotation_history();
+	`
+}
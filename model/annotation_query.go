@@ -0,0 +1,215 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	"strings"
+	"time"
+)
+
+var ErrAnnotationNotFound = errors.New("annotation not found")
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type AnnotationOrder string
+
+const (
+	// OrderById keeps the order in which annotations were stored
+	OrderById AnnotationOrder = ""
+	// OrderByLocation orders annotations of each book by their location, annotations without one first
+	OrderByLocation  AnnotationOrder = "location"
+	OrderByTimestamp AnnotationOrder = "ts"
+)
+
+// AnnotationQuery selects a page of annotations; filters left at their zero value don't filter anything
+type AnnotationQuery struct {
+	BookId int64
+	Type   AnnotationType
+	Origin string
+	// Since (inclusive) and Until (exclusive) limit the timestamp
+	Since time.Time
+	Until time.Time
+	// LocationFrom and LocationTo (both inclusive) limit the start of the Kindle location, or of the page
+	// for annotations without one; annotations with neither are left out when the range is set
+	LocationFrom *int
+	LocationTo   *int
+	// Filter is a parsed query of the query language, nil for none
+	Filter *Filter
+	// IncludeDeleted adds annotations soft-deleted by reconciliation
+	IncludeDeleted bool
+	OrderBy        AnnotationOrder
+	// Limit is the size of a page, 0 for all annotations
+	Limit int
+	// After is the cursor returned with the previous page, empty for the first page
+	After string
+}
+
+type AnnotationPage struct {
+	Annotations []Annotation
+	// Next is the cursor of the next page, empty if this is the last one
+	Next string
+}
+
+// AnnotationReader reads annotations, for consumers which should not write raw SQL against the schema
+type AnnotationReader interface {
+	GetAnnotation(ctx context.Context, id int64) (*Annotation, error)
+	ListAnnotations(ctx context.Context, query AnnotationQuery) (AnnotationPage, error)
+}
+
+func NewDBAnnotationReader(db *sql.DB) (AnnotationReader, error) {
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, err
+	}
+	return &annotationRepository{
+		db: db,
+	}, nil
+}
+
+func (r *annotationRepository) GetAnnotation(ctx context.Context, id int64) (*Annotation, error) {
+	a, ok, err := queryAnnotation(ctx, bind(r.db, dialectOf(r.db)), "Id=?", id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrAnnotationNotFound, id)
+	}
+	return a, nil
+}
+
+func (r *annotationRepository) ListAnnotations(ctx context.Context, query AnnotationQuery) (page AnnotationPage, err error) {
+	d := dialectOf(r.db)
+	location := fmt.Sprintf("coalesce(%s, %s)", d.jsonInt("location", "locationStart"), d.jsonInt("location", "pageStart"))
+	var conditions []string
+	var args []interface{}
+	filter := func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+	if !query.IncludeDeleted {
+		conditions = append(conditions, "deleted_at is null")
+	}
+	if query.BookId != 0 {
+		filter("book_id=?", query.BookId)
+	}
+	if query.Type != "" {
+		filter("type=?", query.Type)
+	}
+	if query.Origin != "" {
+		filter("origin=?", query.Origin)
+	}
+	if !query.Since.IsZero() {
+		filter("ts >= ?", query.Since.UTC())
+	}
+	if !query.Until.IsZero() {
+		filter("ts < ?", query.Until.UTC())
+	}
+	if query.LocationFrom != nil {
+		filter(location+" >= ?", *query.LocationFrom)
+	}
+	if query.LocationTo != nil {
+		filter(location+" <= ?", *query.LocationTo)
+	}
+	if query.Filter != nil {
+		if condition, filterArgs := query.Filter.sql(); condition != "" {
+			conditions = append(conditions, condition)
+			args = append(args, filterArgs...)
+		}
+	}
+
+	var keys []string
+	switch query.OrderBy {
+	case OrderById:
+		keys = []string{"Id"}
+	case OrderByLocation:
+		keys = []string{"book_id", "coalesce(" + location + ", -1)", "Id"}
+	case OrderByTimestamp:
+		keys = []string{"ts", "Id"}
+	default:
+		return page, fmt.Errorf("unknown order of annotations %q", query.OrderBy)
+	}
+	if query.After != "" {
+		c, err := decodeCursor(query.After)
+		if err != nil {
+			return page, err
+		}
+		conditions = append(conditions, "("+strings.Join(keys, ", ")+") > ("+strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")+")")
+		args = append(args, c.values(query.OrderBy)...)
+	}
+
+	sqlQuery := "select " + annotationColumns + " from annotation"
+	if len(conditions) > 0 {
+		sqlQuery += " where " + strings.Join(conditions, " and ")
+	}
+	sqlQuery += " order by " + strings.Join(keys, ", ")
+	if query.Limit > 0 {
+		// one more than asked for tells whether there is a next page
+		sqlQuery += " limit ?"
+		args = append(args, query.Limit+1)
+	}
+	rows, err := bind(r.db, d).QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return page, fmt.Errorf("failed to list annotations: %w", err)
+	}
+	defer utils.SafeClose(rows, &err)
+	for rows.Next() {
+		a, err := scanAnnotationRow(rows)
+		if err != nil {
+			return page, err
+		}
+		page.Annotations = append(page.Annotations, *a)
+	}
+	if err := rows.Err(); err != nil {
+		return page, fmt.Errorf("failed to list annotations: %w", err)
+	}
+	if query.Limit > 0 && len(page.Annotations) > query.Limit {
+		page.Annotations = page.Annotations[:query.Limit]
+		page.Next = encodeCursor(page.Annotations[query.Limit-1])
+	}
+	return page, nil
+}
+
+// cursor is the sort key of the last annotation of a page, for any order
+type cursor struct {
+	BookId   int64     `json:"b"`
+	Location int       `json:"l"`
+	Ts       time.Time `json:"t"`
+	Id       int64     `json:"i"`
+}
+
+func encodeCursor(a Annotation) string {
+	c := cursor{BookId: a.BookId, Location: -1, Ts: a.Ts, Id: a.Id}
+	if a.Location.LocationStart != nil {
+		c.Location = *a.Location.LocationStart
+	} else if a.Location.PageStart != nil {
+		c.Location = *a.Location.PageStart
+	}
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeCursor(s string) (c cursor, err error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(decoded, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("%w %q: %v", ErrInvalidCursor, s, err)
+	}
+	return c, nil
+}
+
+// values are the arguments compared with the sort key of the order
+func (c cursor) values(order AnnotationOrder) []interface{} {
+	switch order {
+	case OrderByLocation:
+		return []interface{}{c.BookId, c.Location, c.Id}
+	case OrderByTimestamp:
+		return []interface{}{c.Ts.UTC(), c.Id}
+	default:
+		return []interface{}{c.Id}
+	}
+}
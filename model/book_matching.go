@@ -0,0 +1,60 @@
+package model
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	subtitleRegex = regexp.MustCompile(`(?:\s*[:(\[]|\s+[-–—]\s+).*$`)
+	nonAlnumRegex = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+)
+
+// NormalizeTitle removes subtitle, edition remarks, punctuation and case from the book title,
+// so that titles coming from different sources can be compared
+func NormalizeTitle(title string) string {
+	t := strings.ToLower(title)
+	if stripped := subtitleRegex.ReplaceAllString(t, ""); strings.TrimSpace(stripped) != "" {
+		t = stripped
+	}
+	return strings.TrimSpace(nonAlnumRegex.ReplaceAllString(t, " "))
+}
+
+// SameBook tells if two books are probably the same book coming from different sources:
+// either their ISBNs match, or their normalized titles match and they have at least one common author
+func SameBook(a Book, b Book) bool {
+	if a.Isbn != "" && b.Isbn != "" {
+		return a.Isbn == b.Isbn
+	}
+	normalized := NormalizeTitle(a.Name)
+	if normalized == "" || normalized != NormalizeTitle(b.Name) {
+		return false
+	}
+	return a.Authors == "" || b.Authors == "" || authorsOverlap(a.Authors, b.Authors)
+}
+
+// differentIsbns tells if both books have an ISBN and the ISBNs differ, like two editions of a book with the same title
+func differentIsbns(a Book, b Book) bool {
+	return a.Isbn != "" && b.Isbn != "" && a.Isbn != b.Isbn
+}
+
+func authorsOverlap(a string, b string) bool {
+	tokens := authorTokens(a)
+	for t := range authorTokens(b) {
+		if _, ok := tokens[t]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authorTokens ignores initials and separators, since sources list authors as "Last, First" or "First Last; ..."
+func authorTokens(authors string) map[string]struct{} {
+	tokens := make(map[string]struct{})
+	for _, t := range strings.Fields(nonAlnumRegex.ReplaceAllString(strings.ToLower(authors), " ")) {
+		if len([]rune(t)) > 2 && t != "and" {
+			tokens[t] = struct{}{}
+		}
+	}
+	return tokens
+}
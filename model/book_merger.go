@@ -0,0 +1,126 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+type BookMerger interface {
+	// FindDuplicateBooks returns groups of books which are probably the same book, first book in a group survives the merge
+	FindDuplicateBooks(ctx context.Context) (groups [][]Book, err error)
+	// MergeBooks moves all annotations of duplicates to the survivor and deletes the duplicates
+	MergeBooks(ctx context.Context, survivor *Book, duplicates []Book) error
+}
+
+type bookMerger struct {
+	db *sql.DB
+}
+
+func NewDBBookMerger(db *sql.DB) BookMerger {
+	return &bookMerger{
+		db: db,
+	}
+}
+
+func (m *bookMerger) FindDuplicateBooks(ctx context.Context) (groups [][]Book, err error) {
+	books, err := listBooks(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	var candidates [][]Book
+	for _, book := range books {
+		found := false
+		for i, group := range candidates {
+			if matchesGroup(group, book) {
+				candidates[i] = append(candidates[i], book)
+				found = true
+				break
+			}
+		}
+		if !found {
+			candidates = append(candidates, []Book{book})
+		}
+	}
+	for _, group := range candidates {
+		if len(group) < 2 {
+			continue
+		}
+		// book with ISBN is the most reliable one to keep, otherwise the oldest one
+		for i, book := range group {
+			if book.Isbn != "" {
+				group[0], group[i] = group[i], group[0]
+				break
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// matchesGroup tells if the book is the same as one of the books of the group; a group never gets books with different
+// ISBNs, even if a book without ISBN has the same title as both of them
+func matchesGroup(group []Book, book Book) bool {
+	matches := false
+	for _, member := range group {
+		if book.Isbn != "" && member.Isbn != "" && book.Isbn != member.Isbn {
+			return false
+		}
+		matches = matches || SameBook(member, book)
+	}
+	return matches
+}
+
+func (m *bookMerger) MergeBooks(ctx context.Context, survivor *Book, duplicates []Book) error {
+	return inTransaction(ctx, m.db, func(tx querier) error {
+		for _, duplicate := range duplicates {
+			if duplicate.Id == survivor.Id {
+				continue
+			}
+			if survivor.Isbn != "" && duplicate.Isbn != "" && survivor.Isbn != duplicate.Isbn {
+				return fmt.Errorf("refusing to merge book %v with ISBN %v into book %v with ISBN %v", duplicate.Id, duplicate.Isbn, survivor.Id, survivor.Isbn)
+			}
+			if survivor.Isbn == "" {
+				survivor.Isbn = duplicate.Isbn
+			}
+			if survivor.Authors == "" {
+				survivor.Authors = duplicate.Authors
+			}
+			cause := fmt.Sprintf("merge of book #%d into #%d", duplicate.Id, survivor.Id)
+			if _, err := tx.ExecContext(ctx, "update annotation set book_id=?, change_cause=? where book_id=?", survivor.Id, cause, duplicate.Id); err != nil {
+				return fmt.Errorf("failed to move annotations of book %v to book %v: %w", duplicate.Id, survivor.Id, err)
+			}
+			if _, err := tx.ExecContext(ctx, "delete from book where Id=?", duplicate.Id); err != nil {
+				return fmt.Errorf("failed to delete merged book %v: %w", duplicate.Id, err)
+			}
+			log.Debugf("Merged book %v into book %v", duplicate.Id, survivor.Id)
+		}
+		if _, err := tx.ExecContext(ctx, "update book set isbn=?, authors=? where Id=?", survivor.Isbn, survivor.Authors, survivor.Id); err != nil {
+			return fmt.Errorf("failed to update merged book %v: %w", survivor.Id, err)
+		}
+		return nil
+	})
+}
+
+func listBooks(ctx context.Context, q querier) (books []Book, err error) {
+	return queryBooks(ctx, q, "order by book.id")
+}
+
+// queryBooks reads books selected and ordered by the rest of the query
+func queryBooks(ctx context.Context, q querier, rest string, args ...interface{}) (books []Book, err error) {
+	rows, err := q.QueryContext(ctx, "select book.id, book.name, book.isbn, book.authors from book "+rest, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query books: %w", err)
+	}
+	defer utils.SafeClose(rows, &err)
+	for rows.Next() {
+		var book Book
+		if err := rows.Scan(&book.Id, &book.Name, &book.Isbn, &book.Authors); err != nil {
+			return nil, fmt.Errorf("failed to scan successfully retrieved result set for book: %w", err)
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
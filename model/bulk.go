@@ -0,0 +1,275 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const annotationInsert = `
+	insert into annotation(book_id, location, text, ts, origin, type, chapter_title, chapter_url, chapter_ordinal, source, external_id, fingerprint,
+		created_by_run, updated_by_run, change_cause)
+	values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+`
+
+func annotationInsertArgs(a *Annotation, locationAsString []byte) []interface{} {
+	return []interface{}{a.BookId, string(locationAsString), a.Text, a.Ts, a.Origin, a.Type, a.Chapter.Title, a.Chapter.Url,
+		a.Chapter.Ordinal, a.Source, nullIfEmpty(a.ExternalId), a.Fingerprint, nullIfZero(a.CreatedByRun), nullIfZero(a.UpdatedByRun),
+		upsertCause(a.UpdatedByRun)}
+}
+
+// annotationUpsert is the native upsert of annotations without an external identifier; annotations with one are
+// looked up first instead, since their upsert target is either the external identifier or, for annotations stored
+// before they had one, the fingerprint
+func annotationUpsert(merge string) string {
+	return annotationInsert + `
+	on conflict(book_id, type, location, fingerprint) where external_id is null do update set ` + merge + `
+	returning Id, created_by_run
+`
+}
+
+// BulkSession writes all books and annotations of an ingestion run in transactions of batchSize writes
+// (or in a single transaction if batchSize is 0), reusing the prepared statements within a transaction.
+// Annotations of an import run are written with a single native upsert statement instead of a lookup followed by a write.
+// Commit must be called at the end of the run, otherwise the last batch is lost.
+type BulkSession struct {
+	db        *sql.DB
+	dialect   dialect
+	batchSize int
+	policies  *MergePolicies
+	tx        *sql.Tx
+	upserts   map[string]*sql.Stmt
+	remember  *sql.Stmt
+	writes    int
+	// import run the written annotations are attributed to, and the annotations it created so far
+	run     *ImportRun
+	created map[int64]bool
+	// progress tells how far the input got, committed is where it was when the last batch was committed
+	progress  func() Checkpoint
+	committed *Checkpoint
+	// annotations of the current batch, counted into the run only once the batch is committed
+	batch batchCounts
+}
+
+type batchCounts struct {
+	inserted int
+	updated  int
+	created  map[int64]bool
+}
+
+func NewBulkSession(ctx context.Context, db *sql.DB, batchSize int) (*BulkSession, error) {
+	if err := Migrate(ctx, db); err != nil {
+		return nil, fmt.Errorf("failed to migrate the database schema: %w", err)
+	}
+	return &BulkSession{
+		db:        db,
+		dialect:   dialectOf(db),
+		batchSize: batchSize,
+	}, nil
+}
+
+// SetMergePolicies replaces the default merge policies; it has to be called before the first write
+func (s *BulkSession) SetMergePolicies(policies *MergePolicies) {
+	s.policies = policies
+}
+
+func (s *BulkSession) BookRepository() BookRepository {
+	return &bulkBookRepository{session: s}
+}
+
+func (s *BulkSession) AnnotationRepository() AnnotationRepository {
+	return &bulkAnnotationRepository{session: s}
+}
+
+// Commit commits the current batch, if there is one
+func (s *BulkSession) Commit() error {
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	batch := s.batch
+	s.end()
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit bulk ingestion batch: %w", err)
+	}
+	if s.run != nil {
+		s.run.Inserted += batch.inserted
+		s.run.Updated += batch.updated
+		for id := range batch.created {
+			s.created[id] = true
+		}
+	}
+	if s.progress != nil {
+		reached := s.progress()
+		s.committed = &reached
+	}
+	log.Debugf("Committed bulk ingestion batch")
+	return nil
+}
+
+// Committed returns the checkpoint of the input when the last batch of the run was committed, or nil if none was
+func (s *BulkSession) Committed() *Checkpoint {
+	return s.committed
+}
+
+// Rollback drops the current batch, if there is one; batches committed before are kept
+func (s *BulkSession) Rollback() error {
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	s.end()
+	return tx.Rollback()
+}
+
+func (s *BulkSession) begin(ctx context.Context) (err error) {
+	if s.tx != nil {
+		return nil
+	}
+	// transaction is not bound to ctx, so that what was ingested before cancellation can still be committed
+	tx, err := s.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin bulk ingestion batch: %w", err)
+	}
+	s.tx = tx
+	if s.remember, err = tx.PrepareContext(ctx, s.dialect.rebind(annotationBeforeRunByUpsertTarget)); err != nil {
+		_ = s.Rollback()
+		return fmt.Errorf("failed to prepare annotation upsert: %w", err)
+	}
+	s.upserts = make(map[string]*sql.Stmt)
+	s.batch = batchCounts{created: make(map[int64]bool)}
+	return nil
+}
+
+// attach attributes the following writes to the run, or to no run if it is nil; progress of the input is optional
+func (s *BulkSession) attach(run *ImportRun, progress func() Checkpoint) {
+	s.run = run
+	s.created = make(map[int64]bool)
+	s.progress = progress
+	s.committed = nil
+}
+
+// upsertStatement prepares the native upsert of the source within the current batch, the first time it is needed
+func (s *BulkSession) upsertStatement(ctx context.Context, source string) (*sql.Stmt, error) {
+	if stmt, ok := s.upserts[source]; ok {
+		return stmt, nil
+	}
+	stmt, err := s.tx.PrepareContext(ctx, s.dialect.rebind(annotationUpsert(annotationUpsertMerge(s.policies, source))))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare annotation upsert: %w", err)
+	}
+	s.upserts[source] = stmt
+	return stmt, nil
+}
+
+func (s *BulkSession) end() {
+	statements := []*sql.Stmt{s.remember}
+	for _, upsert := range s.upserts {
+		statements = append(statements, upsert)
+	}
+	for _, stmt := range statements {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}
+	s.tx = nil
+	s.upserts = nil
+	s.remember = nil
+	s.writes = 0
+	s.batch = batchCounts{}
+}
+
+// written commits the batch once it is full
+func (s *BulkSession) written() error {
+	s.writes++
+	if s.batchSize > 0 && s.writes >= s.batchSize {
+		return s.Commit()
+	}
+	return nil
+}
+
+type bulkBookRepository struct {
+	session *BulkSession
+}
+
+func (r *bulkBookRepository) UpsertBook(ctx context.Context, book *Book) (existed bool, err error) {
+	if err := r.session.begin(ctx); err != nil {
+		return false, err
+	}
+	var run int64
+	if r.session.run != nil {
+		run = r.session.run.Id
+	}
+	if existed, err = upsertBook(ctx, bind(r.session.tx, r.session.dialect), book, run, r.session.policies); err != nil {
+		return false, err
+	}
+	return existed, r.session.written()
+}
+
+type bulkAnnotationRepository struct {
+	session *BulkSession
+}
+
+func (r *bulkAnnotationRepository) UpsertAnnotation(ctx context.Context, a *Annotation) (existed bool, err error) {
+	if err := r.session.begin(ctx); err != nil {
+		return false, err
+	}
+	existed, err = r.upsertAnnotation(ctx, a)
+	if err != nil {
+		if r.session.run != nil {
+			r.session.run.Failed++
+		}
+		return false, err
+	}
+	if existed {
+		r.session.batch.updated++
+	} else {
+		r.session.batch.inserted++
+	}
+	return existed, r.session.written()
+}
+
+func (r *bulkAnnotationRepository) upsertAnnotation(ctx context.Context, a *Annotation) (existed bool, err error) {
+	run := r.session.run
+	// without a run, the native upsert can not tell an insert from an update
+	if a.ExternalId != "" || run == nil {
+		if run != nil {
+			a.UpdatedByRun = run.Id
+			a.CreatedByRun = run.Id
+		}
+		return upsertAnnotation(ctx, bind(r.session.tx, r.session.dialect), a, r.session.policies)
+	}
+	a.UpdatedByRun = run.Id
+	a.CreatedByRun = run.Id
+	stmt, err := r.session.upsertStatement(ctx, a.Source)
+	if err != nil {
+		return false, err
+	}
+	a.Fingerprint = Fingerprint(a.Text)
+	locationAsString, err := json.Marshal(a.Location)
+	if err != nil {
+		return false, fmt.Errorf("could not serialize into JSON %+v: %w", a.Location, err)
+	}
+	// native upsert does not tell what it overwrote, so the row it is going to update is remembered first
+	_, err = r.session.remember.ExecContext(ctx, run.Id, a.BookId, a.Type, string(locationAsString), a.Fingerprint)
+	if err != nil {
+		return false, fmt.Errorf("failed to remember annotation before the import run: %w", err)
+	}
+	var createdByRun sql.NullInt64
+	err = stmt.QueryRowContext(ctx, annotationInsertArgs(a, locationAsString)...).Scan(&a.Id, &createdByRun)
+	if err != nil {
+		return false, fmt.Errorf("failed to upsert annotation: %w", err)
+	}
+	// only this session writes rows of its run, so a row of the run which it has not seen yet was just inserted,
+	// even if other writers insert annotations at the same time
+	existed = createdByRun.Int64 != run.Id || r.session.created[a.Id] || r.session.batch.created[a.Id]
+	if existed {
+		log.Debugf("Updated existing annotation with Id %v", a.Id)
+	} else {
+		r.session.batch.created[a.Id] = true
+		log.Debugf("Inserted new annotation with Id %v", a.Id)
+	}
+	return existed, nil
+}
@@ -0,0 +1,240 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBulkUpsertCountsInsertsAndUpdates(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDatabase(t)
+	// annotation stored by an earlier run has a lower Id, but so would one inserted by another writer meanwhile
+	first := startTestRun(t, db, "first")
+	writeAnnotations(t, db, first, 0, testAnnotations(3, 1))
+	second := startTestRun(t, db, "second")
+	session, err := NewBulkSession(ctx, db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.attach(second, nil)
+	annotations := testAnnotations(5, 1)
+	// annotation written twice within a run is inserted once, even across batches
+	annotations = append(annotations, annotations[4])
+	repo := session.AnnotationRepository()
+	var inserted, updated int
+	for i := range annotations {
+		a := annotations[i]
+		existed, err := repo.UpsertAnnotation(ctx, &a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if existed {
+			updated++
+		} else {
+			inserted++
+		}
+	}
+	if err := session.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 2 || updated != 4 {
+		t.Errorf("expected 2 inserted and 4 updated annotations, got %d inserted and %d updated", inserted, updated)
+	}
+}
+
+func TestBulkUpsertMergesLikeUpsertAnnotation(t *testing.T) {
+	fields := []string{FieldText, FieldTs, FieldOrigin, FieldChapter}
+	for _, field := range fields {
+		for _, policy := range mergePolicies {
+			policies := DefaultMergePolicies()
+			if err := policies.Set(field + "=" + string(policy)); err != nil {
+				continue
+			}
+			t.Run(field+"="+string(policy), func(t *testing.T) {
+				existing := Annotation{
+					BookId:   1,
+					Text:     "It's a short highlight",
+					Location: Location{LocationStart: intPtr(10)},
+					Ts:       time.Date(2022, 1, 2, 10, 0, 0, 0, time.UTC),
+					Origin:   "existing",
+					Type:     Highlight,
+					Source:   "test",
+				}
+				incoming := existing
+				incoming.Text = "It’s a short highlight"
+				incoming.Ts = existing.Ts.Add(time.Hour)
+				incoming.Origin = ""
+				incoming.Chapter = Chapter{Title: "Chapter 1"}
+				rowByRow := mergeRowByRow(t, policies, existing, incoming)
+				bulk := mergeBulk(t, policies, existing, incoming)
+				if !sameStoredAnnotation(rowByRow, bulk) {
+					t.Errorf("row by row upsert stored %+v, bulk upsert stored %+v", rowByRow, bulk)
+				}
+			})
+		}
+	}
+}
+
+func mergeRowByRow(t *testing.T, policies *MergePolicies, existing Annotation, incoming Annotation) *Annotation {
+	ctx := context.Background()
+	db := openTestDatabase(t)
+	for _, a := range []Annotation{existing, incoming} {
+		run := startTestRun(t, db, "rows")
+		a.UpdatedByRun = run.Id
+		err := inTransaction(ctx, db, func(tx querier) error {
+			_, err := upsertAnnotation(ctx, tx, &a, policies)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return readOnlyAnnotation(t, db)
+}
+
+func mergeBulk(t *testing.T, policies *MergePolicies, existing Annotation, incoming Annotation) *Annotation {
+	ctx := context.Background()
+	db := openTestDatabase(t)
+	for _, a := range []Annotation{existing, incoming} {
+		session, err := NewBulkSession(ctx, db, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.SetMergePolicies(policies)
+		session.attach(startTestRun(t, db, "bulk"), nil)
+		if _, err := session.AnnotationRepository().UpsertAnnotation(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return readOnlyAnnotation(t, db)
+}
+
+func readOnlyAnnotation(t *testing.T, db *sql.DB) *Annotation {
+	rows, err := bind(db, dialectOf(db)).QueryContext(context.Background(), "select "+annotationColumns+" from annotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	a, ok, err := scanAnnotation(rows)
+	if err != nil || !ok {
+		t.Fatalf("expected a stored annotation, got %v", err)
+	}
+	if rows.Next() {
+		t.Fatalf("expected a single stored annotation")
+	}
+	return a
+}
+
+func sameStoredAnnotation(a *Annotation, b *Annotation) bool {
+	return a.Text == b.Text && a.Fingerprint == b.Fingerprint && a.Ts.Equal(b.Ts) && a.Origin == b.Origin &&
+		a.Chapter.Title == b.Chapter.Title && a.Type == b.Type && a.Source == b.Source && a.ExternalId == b.ExternalId &&
+		locationKey(a.Location) == locationKey(b.Location)
+}
+
+func locationKey(l Location) string {
+	locationAsString, _ := json.Marshal(l)
+	return string(locationAsString)
+}
+
+// testAnnotations generates n distinct highlights spread over the books
+func testAnnotations(n int, books int) []Annotation {
+	annotations := make([]Annotation, n)
+	ts := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i := range annotations {
+		annotations[i] = Annotation{
+			BookId:   int64(i%books + 1),
+			Text:     fmt.Sprintf("Generated highlight number %d, long enough to look like a real sentence from a book.", i),
+			Location: Location{LocationStart: intPtr(i * 10), LocationEnd: intPtr(i*10 + 5)},
+			Ts:       ts.Add(time.Duration(i) * time.Minute),
+			Origin:   "generated",
+			Type:     Highlight,
+			Source:   "test",
+		}
+	}
+	return annotations
+}
+
+// writeAnnotations writes the annotations within the run, in a bulk session of batchSize writes
+func writeAnnotations(t testing.TB, db *sql.DB, run *ImportRun, batchSize int, annotations []Annotation) {
+	ctx := context.Background()
+	session, err := NewBulkSession(ctx, db, batchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.attach(run, nil)
+	repo := session.AnnotationRepository()
+	for i := range annotations {
+		a := annotations[i]
+		if _, err := repo.UpsertAnnotation(ctx, &a); err != nil {
+			_ = session.Rollback()
+			t.Fatal(err)
+		}
+	}
+	if err := session.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// benchmarked ingestion writes benchRecords annotations of benchBooks books, the same amount as docs/benchmarks.md
+const (
+	benchRecords = 20000
+	benchBooks   = 50
+)
+
+func BenchmarkIngestPerAnnotation(b *testing.B) {
+	benchmarkIngest(b, func(db *sql.DB, annotations []Annotation) {
+		repo, err := NewDBAnnotationRepository(db)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for i := range annotations {
+			a := annotations[i]
+			if _, err := repo.UpsertAnnotation(context.Background(), &a); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkIngestBulk(b *testing.B) {
+	benchmarkIngest(b, func(db *sql.DB, annotations []Annotation) {
+		writeAnnotations(b, db, startTestRun(b, db, "bench"), 0, annotations)
+	})
+}
+
+func BenchmarkIngestBulkBatches(b *testing.B) {
+	benchmarkIngest(b, func(db *sql.DB, annotations []Annotation) {
+		writeAnnotations(b, db, startTestRun(b, db, "bench"), 1000, annotations)
+	})
+}
+
+// benchmarkIngest measures the initial import into a new database, and the re-import of the same annotations,
+// where every annotation is an update
+func benchmarkIngest(b *testing.B, ingest func(db *sql.DB, annotations []Annotation)) {
+	annotations := testAnnotations(benchRecords, benchBooks)
+	b.Run("initial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := openTestDatabase(b)
+			b.StartTimer()
+			ingest(db, annotations)
+		}
+	})
+	b.Run("reimport", func(b *testing.B) {
+		db := openTestDatabase(b)
+		ingest(db, annotations)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ingest(db, annotations)
+		}
+	})
+}
@@ -19,6 +19,10 @@ func NewCachedBookRepository(delegate BookRepository) BookRepository {
 }
 
 func (c *CachedBookRepository) UpsertBook(ctx context.Context, book *Book) (bool, error) {
+	// books are cached by the normalized ISBN they are stored with
+	if err := normalizeIsbn(book); err != nil {
+		return false, err
+	}
 	if cachedBook, ok := c.knownBooks[c.Hash(*book)]; ok {
 		log.Debugf("Skipping book update for %v", book)
 		book.Id = cachedBook.Id
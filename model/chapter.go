@@ -0,0 +1,47 @@
+package model
+
+import (
+	"sort"
+)
+
+type Chapter struct {
+	Title   string
+	Url     string
+	Ordinal *int
+}
+
+func (c Chapter) IsEmpty() bool {
+	return c.Title == "" && c.Url == "" && c.Ordinal == nil
+}
+
+type ChapterGroup struct {
+	Chapter     Chapter
+	Annotations []Annotation
+}
+
+// GroupByChapter keeps annotations of the same chapter together, ordering chapters by their ordinal
+// (chapters without an ordinal go last, in order of first appearance)
+func GroupByChapter(annotations []Annotation) []ChapterGroup {
+	var groups []ChapterGroup
+	index := make(map[string]int)
+	for _, a := range annotations {
+		key := a.Chapter.Url + "/" + a.Chapter.Title
+		if i, ok := index[key]; ok {
+			groups[i].Annotations = append(groups[i].Annotations, a)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, ChapterGroup{
+			Chapter:     a.Chapter,
+			Annotations: []Annotation{a},
+		})
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		oi, oj := groups[i].Chapter.Ordinal, groups[j].Chapter.Ordinal
+		if oi == nil || oj == nil {
+			return oi != nil && oj == nil
+		}
+		return *oi < *oj
+	})
+	return groups
+}
@@ -0,0 +1,172 @@
+package model
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"time"
+)
+
+// Checkpoint marks how far an interrupted ingestion got, so that the next run can continue from there
+type Checkpoint struct {
+	// Records is the number of records which were fully ingested
+	Records int
+	// Hash of all the ingested records, to recognize if the input changed since the interruption
+	Hash string
+}
+
+type CheckpointRepository interface {
+	// LoadCheckpoint returns nil if the last ingestion of the origin was not interrupted
+	LoadCheckpoint(ctx context.Context, origin string) (*Checkpoint, error)
+	SaveCheckpoint(ctx context.Context, origin string, c Checkpoint) error
+	ClearCheckpoint(ctx context.Context, origin string) error
+}
+
+type checkpointRepository struct {
+	db querier
+}
+
+func NewDBCheckpointRepository(db *sql.DB) (CheckpointRepository, error) {
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, err
+	}
+	return &checkpointRepository{
+		db: bind(db, dialectOf(db)),
+	}, nil
+}
+
+func (r *checkpointRepository) LoadCheckpoint(ctx context.Context, origin string) (*Checkpoint, error) {
+	c := &Checkpoint{}
+	err := r.db.QueryRowContext(ctx, "select records, hash from ingestion_checkpoint where origin=?", origin).Scan(&c.Records, &c.Hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint of %v: %w", origin, err)
+	}
+	return c, nil
+}
+
+func (r *checkpointRepository) SaveCheckpoint(ctx context.Context, origin string, c Checkpoint) error {
+	_, err := r.db.ExecContext(ctx, `
+	insert into ingestion_checkpoint(origin, records, hash, updated_at) values(?,?,?,?)
+	on conflict(origin) do update set records=excluded.records, hash=excluded.hash, updated_at=excluded.updated_at`,
+		origin, c.Records, c.Hash, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint of %v: %w", origin, err)
+	}
+	return nil
+}
+
+func (r *checkpointRepository) ClearCheckpoint(ctx context.Context, origin string) error {
+	if _, err := r.db.ExecContext(ctx, "delete from ingestion_checkpoint where origin=?", origin); err != nil {
+		return fmt.Errorf("failed to clear checkpoint of %v: %w", origin, err)
+	}
+	return nil
+}
+
+// Progress counts the records of an input as they are ingested and, when resuming from a checkpoint,
+// holds back the records which were already ingested by the interrupted run
+type Progress[T any] struct {
+	resumeFrom *Checkpoint
+	records    int
+	// hash of the ingested records
+	hash hash.Hash
+	// keys of the records returned by Track, but not yet ingested
+	pending  []string
+	held     []T
+	heldKeys []string
+}
+
+func NewProgress[T any](resumeFrom *Checkpoint) *Progress[T] {
+	if resumeFrom != nil && resumeFrom.Records == 0 {
+		resumeFrom = nil
+	}
+	return &Progress[T]{
+		resumeFrom: resumeFrom,
+		hash:       sha1.New(),
+	}
+}
+
+// Track registers the next record of the input (key is its textual form) and returns records to be ingested:
+// none while the input still matches the interrupted run, otherwise the record itself. If the input turned out
+// to be different than the one which was interrupted, the held back records are returned as well.
+// Each of the returned records counts as ingested only after Done is called for it.
+func (p *Progress[T]) Track(record T, key string) []T {
+	if p.resumeFrom == nil {
+		p.pending = append(p.pending, key)
+		return []T{record}
+	}
+	p.held = append(p.held, record)
+	p.heldKeys = append(p.heldKeys, key)
+	if len(p.held) < p.resumeFrom.Records {
+		return nil
+	}
+	prefix := sha1.New()
+	for _, k := range p.heldKeys {
+		writeKey(prefix, k)
+	}
+	if hex.EncodeToString(prefix.Sum(nil)) != p.resumeFrom.Hash {
+		return p.abandonCheckpoint()
+	}
+	p.hash = prefix
+	p.records = len(p.held)
+	p.resumeFrom = nil
+	p.held = nil
+	p.heldKeys = nil
+	return nil
+}
+
+// Flush returns the held back records at the end of the input, since the input turned out to be shorter than
+// the one which was interrupted
+func (p *Progress[T]) Flush() []T {
+	if p.resumeFrom == nil || len(p.held) == 0 {
+		return nil
+	}
+	return p.abandonCheckpoint()
+}
+
+func (p *Progress[T]) abandonCheckpoint() []T {
+	log.Warnf("Input does not match the interrupted ingestion anymore, ingesting it from the start")
+	held := p.held
+	p.pending = append(p.pending, p.heldKeys...)
+	p.resumeFrom = nil
+	p.held = nil
+	p.heldKeys = nil
+	return held
+}
+
+// Done marks the oldest record returned by Track as ingested
+func (p *Progress[T]) Done() {
+	if len(p.pending) == 0 {
+		return
+	}
+	writeKey(p.hash, p.pending[0])
+	p.pending = p.pending[1:]
+	p.records++
+}
+
+// Resuming tells if the records are still held back because they were ingested by the interrupted run
+func (p *Progress[T]) Resuming() bool {
+	return p.resumeFrom != nil
+}
+
+func (p *Progress[T]) Records() int {
+	return p.records
+}
+
+// Checkpoint returns the point from which ingestion of the input can continue
+func (p *Progress[T]) Checkpoint() Checkpoint {
+	if p.resumeFrom != nil {
+		return *p.resumeFrom
+	}
+	return Checkpoint{Records: p.records, Hash: hex.EncodeToString(p.hash.Sum(nil))}
+}
+
+func writeKey(h hash.Hash, key string) {
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+}
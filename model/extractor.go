@@ -2,9 +2,138 @@ package model
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	log "github.com/sirupsen/logrus"
+	"hash"
 	"io"
+	"time"
 )
 
 type Extractor interface {
+	// Name is the source of the annotations the extractor ingests (kindle, oreilly...)
+	Name() string
+	// Detect tells whether the beginning of an input (at most DetectHeadSize bytes) is in the format of the extractor
+	Detect(head []byte) bool
 	IngestRecords(ctx context.Context, reader io.Reader) (err error)
 }
+
+// ResumableExtractor stops at a record boundary when the context is cancelled, and can continue from that point
+type ResumableExtractor interface {
+	Extractor
+	// ResumeFrom makes the next IngestRecords skip the records ingested by an interrupted run
+	ResumeFrom(c *Checkpoint)
+	// Checkpoint tells how far the last IngestRecords got
+	Checkpoint() Checkpoint
+}
+
+// InvalidRecordCounter is implemented by extractors which skip invalid records of the input instead of failing;
+// the skipped records count as failed ones of the import run
+type InvalidRecordCounter interface {
+	// InvalidRecords is the number of records the last IngestRecords skipped
+	InvalidRecords() int
+}
+
+// InterruptedError is returned when ingestion was cancelled; records ingested until then are committed
+type InterruptedError struct {
+	Origin  string
+	Records int
+	Cause   error
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("ingestion of %v interrupted after %d records: %v", e.Origin, e.Records, e.Cause)
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Cause
+}
+
+// Ingest runs the extractor over the input within the bulk session and records it as the import run
+// (Source and Origin of run have to be set), continuing from the checkpoint of an interrupted ingestion
+// of the same origin. When ctx is cancelled, the records ingested so far are committed and a new checkpoint is
+// saved, so that the next run continues from there
+func Ingest(ctx context.Context, session *BulkSession, checkpoints CheckpointRepository, runs ImportRunRepository,
+	extractor ResumableExtractor, run *ImportRun, reader io.Reader) error {
+	return ingest(ctx, session, checkpoints, runs, extractor, run, reader, false)
+}
+
+// IngestIncrementally is Ingest which keeps the checkpoint after a successful ingestion as well, so that the next
+// ingestion of the same origin skips the records ingested until then (unless the input changed in other ways than
+// by appending to it). It suits append-only inputs, like Kindle clippings
+func IngestIncrementally(ctx context.Context, session *BulkSession, checkpoints CheckpointRepository, runs ImportRunRepository,
+	extractor ResumableExtractor, run *ImportRun, reader io.Reader) error {
+	return ingest(ctx, session, checkpoints, runs, extractor, run, reader, true)
+}
+
+func ingest(ctx context.Context, session *BulkSession, checkpoints CheckpointRepository, runs ImportRunRepository,
+	extractor ResumableExtractor, run *ImportRun, reader io.Reader, incremental bool) error {
+	origin := run.Origin
+	checkpoint, err := checkpoints.LoadCheckpoint(ctx, origin)
+	if err != nil {
+		return err
+	}
+	if checkpoint != nil {
+		if incremental {
+			log.Debugf("Continuing ingestion of %v after %d records ingested before", origin, checkpoint.Records)
+		} else {
+			log.Infof("Resuming ingestion of %v after %d records", origin, checkpoint.Records)
+		}
+		run.Resumed = true
+	}
+	run.StartedAt = time.Now()
+	run.ToolVersion = utils.ToolVersion()
+	if err := runs.StartImportRun(ctx, run); err != nil {
+		return err
+	}
+	session.attach(run, extractor.Checkpoint)
+	defer session.attach(nil, nil)
+	content := sha256.New()
+	extractor.ResumeFrom(checkpoint)
+	err = extractor.IngestRecords(ctx, io.TeeReader(reader, content))
+	if counter, ok := extractor.(InvalidRecordCounter); ok {
+		run.Failed += counter.InvalidRecords()
+	}
+	// ctx might be done, but what was ingested still has to be stored
+	cleanupCtx := context.Background()
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		_ = session.Rollback()
+		finish(cleanupCtx, runs, run, content)
+		// batches committed before the failure are kept, so the next run continues after them
+		if reached := session.Committed(); reached != nil {
+			if err := checkpoints.SaveCheckpoint(cleanupCtx, origin, *reached); err != nil {
+				log.Errorf("Failed to save the checkpoint of the committed records: %v", err)
+			} else {
+				log.Warnf("Ingestion of %v failed, %d records were committed; the next run continues after them", origin, reached.Records)
+			}
+		}
+		return err
+	}
+	if err := session.Commit(); err != nil {
+		return err
+	}
+	finish(cleanupCtx, runs, run, content)
+	if err != nil {
+		reached := extractor.Checkpoint()
+		if err := checkpoints.SaveCheckpoint(cleanupCtx, origin, reached); err != nil {
+			return err
+		}
+		return &InterruptedError{Origin: origin, Records: reached.Records, Cause: err}
+	}
+	if incremental {
+		return checkpoints.SaveCheckpoint(ctx, origin, extractor.Checkpoint())
+	}
+	return checkpoints.ClearCheckpoint(ctx, origin)
+}
+
+// finish records the end of the run; failing to do so does not undo the ingestion
+func finish(ctx context.Context, runs ImportRunRepository, run *ImportRun, content hash.Hash) {
+	run.FinishedAt = time.Now()
+	run.ContentHash = hex.EncodeToString(content.Sum(nil))
+	if err := runs.FinishImportRun(ctx, run); err != nil {
+		log.Errorf("Failed to record the end of import run: %v", err)
+	}
+}
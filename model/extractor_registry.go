@@ -0,0 +1,88 @@
+package model
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// DetectHeadSize is how much of an input is read to detect its format
+const DetectHeadSize = 8 * 1024
+
+var ErrUnknownFormat = errors.New("unknown input format")
+var ErrUnknownExtractor = errors.New("unknown extractor")
+
+// ExtractorFactory creates an extractor writing to the repositories; origin names the input
+type ExtractorFactory func(books BookRepository, annotations AnnotationRepository, origin string) ResumableExtractor
+
+// ExtractorRegistry knows all extractors, so that an input can be routed to the one which understands its format
+type ExtractorRegistry struct {
+	factories map[string]ExtractorFactory
+	// prototypes are extractors without repositories, used only for their Name and Detect
+	prototypes []Extractor
+}
+
+func NewExtractorRegistry(factories ...ExtractorFactory) *ExtractorRegistry {
+	r := &ExtractorRegistry{factories: make(map[string]ExtractorFactory)}
+	for _, factory := range factories {
+		r.Register(factory)
+	}
+	return r
+}
+
+// Register adds the extractor created by the factory under its name, replacing one already registered with it
+func (r *ExtractorRegistry) Register(factory ExtractorFactory) {
+	prototype := factory(nil, nil, "")
+	if _, ok := r.factories[prototype.Name()]; ok {
+		for i, p := range r.prototypes {
+			if p.Name() == prototype.Name() {
+				r.prototypes = append(r.prototypes[:i], r.prototypes[i+1:]...)
+				break
+			}
+		}
+	}
+	r.factories[prototype.Name()] = factory
+	r.prototypes = append(r.prototypes, prototype)
+}
+
+// Names of the registered extractors, sorted
+func (r *ExtractorRegistry) Names() []string {
+	var names []string
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *ExtractorRegistry) New(name string, books BookRepository, annotations AnnotationRepository, origin string) (ResumableExtractor, error) {
+	factory, ok := r.factories[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q, known extractors are %v", ErrUnknownExtractor, name, r.Names())
+	}
+	return factory(books, annotations, origin), nil
+}
+
+// Detect finds the extractor whose format the head of an input is in; the first registered one wins if several match
+func (r *ExtractorRegistry) Detect(head []byte) (name string, err error) {
+	for _, p := range r.prototypes {
+		if p.Detect(head) {
+			return p.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("%w, known formats are %v", ErrUnknownFormat, r.Names())
+}
+
+// DetectInput detects the format of the input by its head; the returned reader has to be used instead of
+// the input, since it still includes the head
+func (r *ExtractorRegistry) DetectInput(input io.Reader) (name string, reader io.Reader, err error) {
+	buffered := bufio.NewReaderSize(input, DetectHeadSize)
+	head, err := buffered.Peek(DetectHeadSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", nil, fmt.Errorf("failed to read the input: %w", err)
+	}
+	name, err = r.Detect(head)
+	return name, buffered, err
+}
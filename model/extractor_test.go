@@ -0,0 +1,100 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// failingExtractor writes an annotation per record and fails at the record failAt (counted from 0)
+type failingExtractor struct {
+	annotations AnnotationRepository
+	records     []Annotation
+	failAt      int
+	progress    *Progress[Annotation]
+}
+
+func (e *failingExtractor) Name() string {
+	return "test"
+}
+
+func (e *failingExtractor) Detect([]byte) bool {
+	return true
+}
+
+func (e *failingExtractor) ResumeFrom(c *Checkpoint) {
+	e.progress = NewProgress[Annotation](c)
+}
+
+func (e *failingExtractor) Checkpoint() Checkpoint {
+	return e.progress.Checkpoint()
+}
+
+func (e *failingExtractor) IngestRecords(ctx context.Context, _ io.Reader) error {
+	for i, record := range e.records {
+		if i == e.failAt {
+			return errTestFailure
+		}
+		for _, a := range e.progress.Track(record, record.Text) {
+			if _, err := e.annotations.UpsertAnnotation(ctx, &a); err != nil {
+				return err
+			}
+			e.progress.Done()
+		}
+	}
+	return nil
+}
+
+var errTestFailure = errors.New("test failure")
+
+func TestIngestFailureKeepsCommittedBatches(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDatabase(t)
+	session, err := NewBulkSession(ctx, db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints, err := NewDBCheckpointRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs, err := NewDBImportRunRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractor := &failingExtractor{annotations: session.AnnotationRepository(), records: testAnnotations(6, 1), failAt: 5}
+	run := &ImportRun{Source: "test", Origin: "input"}
+	err = Ingest(ctx, session, checkpoints, runs, extractor, run, strings.NewReader(""))
+	if !errors.Is(err, errTestFailure) {
+		t.Fatalf("expected the failure of the extractor, got %v", err)
+	}
+	// fifth annotation was written in a batch which was rolled back
+	var stored int
+	if err := db.QueryRow("select count(*) from annotation").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 4 || run.Inserted != 4 || run.Updated != 0 {
+		t.Errorf("expected 4 committed inserts, got %d stored, %d inserted and %d updated", stored, run.Inserted, run.Updated)
+	}
+	checkpoint, err := checkpoints.LoadCheckpoint(ctx, "input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint == nil || checkpoint.Records < 3 || checkpoint.Records > 4 {
+		t.Fatalf("expected a checkpoint within the committed records, got %+v", checkpoint)
+	}
+
+	extractor.failAt = -1
+	resumed := &ImportRun{Source: "test", Origin: "input"}
+	if err := Ingest(ctx, session, checkpoints, runs, extractor, resumed, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select count(*) from annotation").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 6 || resumed.Inserted != 2 {
+		t.Errorf("expected the resumed run to insert the 2 remaining annotations, got %d stored and %d inserted", stored, resumed.Inserted)
+	}
+}
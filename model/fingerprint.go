@@ -0,0 +1,74 @@
+package model
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+var quoteFolder = strings.NewReplacer(
+	"‘", "'", "’", "'", "‚", "'", "‛", "'", "′", "'",
+	"“", `"`, "”", `"`, "„", `"`, "‟", `"`, "″", `"`, "«", `"`, "»", `"`,
+)
+
+// NormalizeText folds differences which appear when the same annotation is exported again
+// (Unicode composition, curly quotes, whitespace, case and trailing punctuation)
+func NormalizeText(text string) string {
+	t := norm.NFC.String(text)
+	t = quoteFolder.Replace(t)
+	t = strings.ToLower(strings.Join(strings.Fields(t), " "))
+	return strings.TrimRightFunc(t, func(r rune) bool {
+		return unicode.IsPunct(r) && r != '"' && r != '\'' || unicode.IsSpace(r)
+	})
+}
+
+// Fingerprint identifies annotation text regardless of the differences folded by NormalizeText
+func Fingerprint(text string) string {
+	sum := sha1.Sum([]byte(NormalizeText(text)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Similarity of two normalized texts, as 1 - (edit distance / length of the longer text)
+func Similarity(a string, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longer := len(ra)
+	if len(rb) > longer {
+		longer = len(rb)
+	}
+	if longer == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longer)
+}
+
+func levenshtein(a []rune, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minOf(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minOf(values ...int) int {
+	result := values[0]
+	for _, v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "case and whitespace", text: "  The Quick\n\tbrown  fox ", want: "the quick brown fox"},
+		{name: "curly quotes", text: "It’s “quoted”", want: `it's "quoted"`},
+		{name: "guillemets", text: "«quoted»", want: `"quoted"`},
+		{name: "trailing punctuation", text: "The end...!", want: "the end"},
+		{name: "trailing quote is kept", text: "He said \"stop.\"", want: `he said "stop."`},
+		{name: "inner punctuation is kept", text: "First, second; third.", want: "first, second; third"},
+		{name: "decomposed accents", text: "Cafe\u0301", want: "caf\u00e9"},
+		{name: "empty", text: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeText(tt.text); got != tt.want {
+				t.Errorf("NormalizeText(%q) = %q, expected %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		same bool
+	}{
+		{name: "same text", a: "Distributed systems fail.", b: "Distributed systems fail.", same: true},
+		{name: "exported again", a: "It's a “trade-off”.", b: "it’s a \"trade-off\"", same: true},
+		{name: "rewrapped", a: "Distributed\nsystems  fail", b: "Distributed systems fail", same: true},
+		{name: "different words", a: "Distributed systems fail", b: "Distributed systems work", same: false},
+		{name: "different inner punctuation", a: "Let's eat, grandma", b: "Let's eat grandma", same: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := Fingerprint(tt.a) == Fingerprint(tt.b); same != tt.same {
+				t.Errorf("Fingerprint(%q) == Fingerprint(%q) is %v, expected %v", tt.a, tt.b, same, tt.same)
+			}
+		})
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want float64
+	}{
+		{a: "", b: "", want: 1},
+		{a: "abc", b: "abc", want: 1},
+		{a: "abc", b: "", want: 0},
+		{a: "kitten", b: "sitting", want: 1 - 3.0/7},
+		{a: "čaša", b: "casa", want: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"/"+tt.b, func(t *testing.T) {
+			if got := Similarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Similarity(%q, %q) = %v, expected %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const annotationBeforeRunColumns = "book_id, text, location, ts, origin, type, chapter_title, chapter_url, chapter_ordinal, source, external_id, fingerprint, updated_by_run, deleted_at"
+
+// only the first write of a run is remembered, that is how the row looked before the run
+const (
+	bookBeforeRunInsert = `
+	insert into book_before_run(run_id, book_id, isbn, name, normalized_name, authors, updated_by_run)
+	select cast(? as bigint), Id, isbn, name, normalized_name, authors, updated_by_run from book where Id=?
+	on conflict(run_id, book_id) do nothing
+`
+	annotationBeforeRunInsert = `
+	insert into annotation_before_run(run_id, annotation_id, ` + annotationBeforeRunColumns + `)
+	select cast(? as bigint), Id, ` + annotationBeforeRunColumns + ` from annotation where Id=?
+	on conflict(run_id, annotation_id) do nothing
+`
+	// annotationBeforeRunByUpsertTarget remembers the annotation which the native upsert is going to update, if any
+	annotationBeforeRunByUpsertTarget = `
+	insert into annotation_before_run(run_id, annotation_id, ` + annotationBeforeRunColumns + `)
+	select cast(? as bigint), Id, ` + annotationBeforeRunColumns + ` from annotation
+	where book_id=? and type=? and location=? and fingerprint=? and external_id is null
+	on conflict(run_id, annotation_id) do nothing
+`
+)
+
+func rememberBook(ctx context.Context, q querier, run int64, bookId int64) error {
+	if _, err := q.ExecContext(ctx, bookBeforeRunInsert, run, bookId); err != nil {
+		return fmt.Errorf("failed to remember book %v before import run %v: %w", bookId, run, err)
+	}
+	return nil
+}
+
+func rememberAnnotation(ctx context.Context, q querier, run int64, annotationId int64) error {
+	if _, err := q.ExecContext(ctx, annotationBeforeRunInsert, run, annotationId); err != nil {
+		return fmt.Errorf("failed to remember annotation %v before import run %v: %w", annotationId, run, err)
+	}
+	return nil
+}
+
+var ErrRunNotFound = errors.New("import run not found")
+var ErrRunAlreadyReverted = errors.New("import run already reverted")
+
+// RevertResult tells what reverting an import run changed, and what it had to leave as it is
+type RevertResult struct {
+	DeletedAnnotations  int
+	RestoredAnnotations int
+	DeletedBooks        int
+	RestoredBooks       int
+	// Skipped counts rows written by the run which were written again by a later run, so they are left as they are
+	Skipped int
+}
+
+type ImportReverter interface {
+	ListImportRuns(ctx context.Context) ([]ImportRun, error)
+	// RevertImportRun deletes annotations and books created by the run and restores the ones it updated
+	RevertImportRun(ctx context.Context, run int64) (RevertResult, error)
+}
+
+type importReverter struct {
+	db *sql.DB
+}
+
+func NewDBImportReverter(db *sql.DB) ImportReverter {
+	return &importReverter{
+		db: db,
+	}
+}
+
+func (r *importReverter) ListImportRuns(ctx context.Context) (runs []ImportRun, err error) {
+	rows, err := bind(r.db, dialectOf(r.db)).QueryContext(ctx, `
+	select Id, source, origin, coalesce(content_hash, ''), started_at, finished_at, tool_version,
+		coalesce(inserted, 0), coalesce(updated, 0), coalesce(failed, 0), reverted_at
+	from import_run order by Id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list import runs: %w", err)
+	}
+	defer utils.SafeClose(rows, &err)
+	for rows.Next() {
+		var run ImportRun
+		var finishedAt, revertedAt sql.NullTime
+		err := rows.Scan(&run.Id, &run.Source, &run.Origin, &run.ContentHash, &run.StartedAt, &finishedAt, &run.ToolVersion,
+			&run.Inserted, &run.Updated, &run.Failed, &revertedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan import run: %w", err)
+		}
+		run.FinishedAt = finishedAt.Time
+		run.RevertedAt = revertedAt.Time
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (r *importReverter) RevertImportRun(ctx context.Context, run int64) (result RevertResult, err error) {
+	err = inTransaction(ctx, r.db, func(tx querier) error {
+		var revertedAt sql.NullTime
+		err := tx.QueryRowContext(ctx, "select reverted_at from import_run where Id=?", run).Scan(&revertedAt)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: %v", ErrRunNotFound, run)
+		} else if err != nil {
+			return fmt.Errorf("failed to find import run %v: %w", run, err)
+		}
+		if revertedAt.Valid {
+			return fmt.Errorf("%w: %v", ErrRunAlreadyReverted, run)
+		}
+		// rows a later run wrote again keep what that run wrote
+		if err := tx.QueryRowContext(ctx, `
+	select
+		(select count(*) from annotation where (created_by_run=? or Id in (select annotation_id from annotation_before_run where run_id=?))
+			and updated_by_run != ?) +
+		(select count(*) from book where (created_by_run=? or Id in (select book_id from book_before_run where run_id=?))
+			and updated_by_run != ?)`,
+			run, run, run, run, run, run).Scan(&result.Skipped); err != nil {
+			return fmt.Errorf("failed to count rows written after import run %v: %w", run, err)
+		}
+		cause := fmt.Sprintf("revert of import run #%d", run)
+		// cause of the deletion has to be on the row for the history
+		if _, err := tx.ExecContext(ctx, "update annotation set change_cause=? where created_by_run=? and updated_by_run=?", cause, run, run); err != nil {
+			return fmt.Errorf("failed to delete annotations created by import run %v: %w", run, err)
+		}
+		if result.DeletedAnnotations, err = execCount(ctx, tx, `
+	delete from annotation where created_by_run=? and updated_by_run=?`, run, run); err != nil {
+			return fmt.Errorf("failed to delete annotations created by import run %v: %w", run, err)
+		}
+		if result.RestoredAnnotations, err = execCount(ctx, tx, `
+	update annotation set (`+annotationBeforeRunColumns+`, change_cause) = (
+		select `+annotationBeforeRunColumns+`, cast(? as text) from annotation_before_run b where b.run_id=? and b.annotation_id=annotation.Id
+	)
+	where updated_by_run=? and Id in (select annotation_id from annotation_before_run where run_id=?)`, cause, run, run, run); err != nil {
+			return fmt.Errorf("failed to restore annotations updated by import run %v: %w", run, err)
+		}
+		if result.RestoredBooks, err = execCount(ctx, tx, `
+	update book set (isbn, name, normalized_name, authors, updated_by_run) = (
+		select isbn, name, normalized_name, authors, updated_by_run from book_before_run b where b.run_id=? and b.book_id=book.Id
+	)
+	where updated_by_run=? and Id in (select book_id from book_before_run where run_id=?)`, run, run, run); err != nil {
+			return fmt.Errorf("failed to restore books updated by import run %v: %w", run, err)
+		}
+		if result.DeletedBooks, err = execCount(ctx, tx, `
+	delete from book where created_by_run=? and updated_by_run=? and not exists (select 1 from annotation where book_id=book.Id)`,
+			run, run); err != nil {
+			return fmt.Errorf("failed to delete books created by import run %v: %w", run, err)
+		}
+		for _, table := range []string{"annotation_before_run", "book_before_run"} {
+			if _, err := tx.ExecContext(ctx, "delete from "+table+" where run_id=?", run); err != nil {
+				return fmt.Errorf("failed to clean up %v of import run %v: %w", table, run, err)
+			}
+		}
+		// the next incremental ingestion of the origin must not skip the records of the run as already ingested
+		if _, err := tx.ExecContext(ctx, "delete from ingestion_checkpoint where origin=(select origin from import_run where Id=?)", run); err != nil {
+			return fmt.Errorf("failed to clear the checkpoint of import run %v: %w", run, err)
+		}
+		if _, err := tx.ExecContext(ctx, "update import_run set reverted_at=? where Id=?", time.Now().UTC(), run); err != nil {
+			return fmt.Errorf("failed to mark import run %v as reverted: %w", run, err)
+		}
+		return nil
+	})
+	if err == nil {
+		log.Debugf("Reverted import run %v: %+v", run, result)
+	}
+	return result, err
+}
+
+func execCount(ctx context.Context, q querier, query string, args ...interface{}) (int, error) {
+	result, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
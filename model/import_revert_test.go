@@ -0,0 +1,93 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestRevertImportRun(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		annotations := testAnnotations(3, 1)
+		writeTestRun(t, db, "first", "", annotations[:2])
+		changed := annotations[1]
+		changed.Origin = "changed"
+		second := writeTestRun(t, db, "second", "", []Annotation{changed, annotations[2]})
+
+		result, err := NewDBImportReverter(db).RevertImportRun(ctx, second.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// book was written again by the second run as well
+		expected := RevertResult{DeletedAnnotations: 1, RestoredAnnotations: 1, RestoredBooks: 1}
+		if result != expected {
+			t.Errorf("expected %+v, got %+v", expected, result)
+		}
+		stored := readTestAnnotations(t, db, "")
+		if len(stored) != 2 {
+			t.Fatalf("expected the 2 annotations of the first run, got %+v", stored)
+		}
+		for _, a := range stored {
+			if a.Origin != "generated" || a.UpdatedByRun == second.Id {
+				t.Errorf("expected annotation %v to be restored, got %+v", a.Id, a)
+			}
+		}
+		if _, err := NewDBImportReverter(db).RevertImportRun(ctx, second.Id); err == nil {
+			t.Errorf("expected reverting the run again to fail")
+		}
+	})
+}
+
+// writeTestRun writes the annotations of the test book in a new import run of the origin and account
+func writeTestRun(t *testing.T, db *sql.DB, origin string, account string, annotations []Annotation) *ImportRun {
+	t.Helper()
+	ctx := context.Background()
+	run := startTestRunOf(t, db, origin, account)
+	session, err := NewBulkSession(ctx, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.attach(run, nil)
+	book := &Book{Name: "Test Book", Authors: "Test Author", Source: "test"}
+	if _, err := session.BookRepository().UpsertBook(ctx, book); err != nil {
+		t.Fatal(err)
+	}
+	for i := range annotations {
+		a := annotations[i]
+		a.BookId = book.Id
+		if _, err := session.AnnotationRepository().UpsertAnnotation(ctx, &a); err != nil {
+			_ = session.Rollback()
+			t.Fatal(err)
+		}
+	}
+	if err := session.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return run
+}
+
+// readTestAnnotations reads all stored annotations matching the condition (or all of them), in order of their Ids
+func readTestAnnotations(t *testing.T, db *sql.DB, condition string, args ...interface{}) []Annotation {
+	t.Helper()
+	if condition == "" {
+		condition = "1=1"
+	}
+	rows, err := bind(db, dialectOf(db)).QueryContext(context.Background(),
+		"select "+annotationColumns+" from annotation where "+condition+" order by Id", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var annotations []Annotation
+	for rows.Next() {
+		a, err := scanAnnotationRow(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotations = append(annotations, *a)
+	}
+	return annotations
+}
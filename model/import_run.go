@@ -0,0 +1,69 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ImportRun is a single ingestion of an input, annotations link to the runs which created and last wrote them
+type ImportRun struct {
+	Id int64
+	// Source is the kind of extractor (kindle, oreilly...)
+	Source string
+	// Origin is the ingested file
+	Origin string
+	// Account labels complete snapshots of the same account of the source, like O'Reilly exports of a user; unlike
+	// the origin, it does not change with the name of the exported file
+	Account string
+	// ContentHash is SHA-256 of the content which was read from the input
+	ContentHash string
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	ToolVersion string
+	Inserted    int
+	Updated     int
+	Failed      int
+	// RevertedAt is zero unless the run was reverted
+	RevertedAt time.Time
+	// Resumed tells that the run continued an interrupted one, so it did not see the whole input; it is not stored
+	Resumed bool
+}
+
+type ImportRunRepository interface {
+	// StartImportRun stores a new run and sets its Id
+	StartImportRun(ctx context.Context, run *ImportRun) error
+	FinishImportRun(ctx context.Context, run *ImportRun) error
+}
+
+type importRunRepository struct {
+	db querier
+}
+
+func NewDBImportRunRepository(db *sql.DB) (ImportRunRepository, error) {
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, err
+	}
+	return &importRunRepository{
+		db: bind(db, dialectOf(db)),
+	}, nil
+}
+
+func (r *importRunRepository) StartImportRun(ctx context.Context, run *ImportRun) error {
+	err := r.db.QueryRowContext(ctx, "insert into import_run(source, origin, account, started_at, tool_version) values(?,?,?,?,?) returning Id",
+		run.Source, run.Origin, run.Account, run.StartedAt.UTC(), run.ToolVersion).Scan(&run.Id)
+	if err != nil {
+		return fmt.Errorf("failed to store import run of %v: %w", run.Origin, err)
+	}
+	return nil
+}
+
+func (r *importRunRepository) FinishImportRun(ctx context.Context, run *ImportRun) error {
+	_, err := r.db.ExecContext(ctx, "update import_run set content_hash=?, finished_at=?, inserted=?, updated=?, failed=? where Id=?",
+		run.ContentHash, run.FinishedAt.UTC(), run.Inserted, run.Updated, run.Failed, run.Id)
+	if err != nil {
+		return fmt.Errorf("failed to finish import run %v: %w", run.Id, err)
+	}
+	return nil
+}
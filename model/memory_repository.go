@@ -0,0 +1,219 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/isbn"
+	"strings"
+)
+
+type ChangeKind string
+
+const (
+	Inserted ChangeKind = "insert"
+	Updated  ChangeKind = "update"
+	Deleted  ChangeKind = "delete"
+)
+
+// Change is a single write of a book or an annotation, like the ones recorded by MemoryStore; either Book or Annotation is set
+type Change struct {
+	Kind       ChangeKind
+	Book       *Book
+	Annotation *Annotation
+}
+
+func (c Change) String() string {
+	if c.Book != nil {
+		return fmt.Sprintf("%s book %d: %s (%s)", c.Kind, c.Book.Id, c.Book.Name, c.Book.Authors)
+	}
+	text := []rune(strings.Join(strings.Fields(c.Annotation.Text), " "))
+	if len(text) > 60 {
+		text = append(text[:57], []rune("...")...)
+	}
+	return fmt.Sprintf("%s %s %d of book %d: %s", c.Kind, c.Annotation.Type, c.Annotation.Id, c.Annotation.BookId, string(text))
+}
+
+// MemoryStore keeps books and annotations in memory, matching and merging them the same way as the database
+// repositories do; all writes are recorded as changes, so that an ingestion can be tried out without
+// writing anything to the database
+type MemoryStore struct {
+	books []*Book
+	// annotations by source and external identifier, and those without one by book, type, location and fingerprint
+	byExternalId     map[string]*Annotation
+	byFingerprint    map[string]*Annotation
+	lastBookId       int64
+	lastAnnotationId int64
+	changes          []Change
+	policies         *MergePolicies
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		byExternalId:  make(map[string]*Annotation),
+		byFingerprint: make(map[string]*Annotation),
+	}
+}
+
+// LoadMemoryStore fills a new store with the books and annotations of the database, without changing the database
+func LoadMemoryStore(ctx context.Context, db *sql.DB) (*MemoryStore, error) {
+	q := bind(db, dialectOf(db))
+	books, err := listBooks(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := listAnnotations(ctx, q, true)
+	if err != nil {
+		return nil, err
+	}
+	s := NewMemoryStore()
+	for i := range books {
+		s.books = append(s.books, &books[i])
+		if books[i].Id > s.lastBookId {
+			s.lastBookId = books[i].Id
+		}
+	}
+	for i := range annotations {
+		s.index(&annotations[i])
+		if annotations[i].Id > s.lastAnnotationId {
+			s.lastAnnotationId = annotations[i].Id
+		}
+	}
+	return s, nil
+}
+
+// SetMergePolicies replaces the default merge policies
+func (s *MemoryStore) SetMergePolicies(policies *MergePolicies) {
+	s.policies = policies
+}
+
+func (s *MemoryStore) BookRepository() BookRepository {
+	return &memoryBookRepository{store: s}
+}
+
+func (s *MemoryStore) AnnotationRepository() AnnotationRepository {
+	return &memoryAnnotationRepository{store: s}
+}
+
+// Changes returns all writes in the order they were made
+func (s *MemoryStore) Changes() []Change {
+	return s.changes
+}
+
+func (s *MemoryStore) index(a *Annotation) {
+	if a.ExternalId != "" {
+		s.byExternalId[externalIdKey(a)] = a
+		return
+	}
+	s.byFingerprint[fingerprintKey(a)] = a
+}
+
+func (s *MemoryStore) unindex(a *Annotation) {
+	if a.ExternalId != "" {
+		delete(s.byExternalId, externalIdKey(a))
+		return
+	}
+	delete(s.byFingerprint, fingerprintKey(a))
+}
+
+func externalIdKey(a *Annotation) string {
+	return a.Source + "\x00" + a.ExternalId
+}
+
+func fingerprintKey(a *Annotation) string {
+	locationAsString, _ := json.Marshal(a.Location)
+	return fmt.Sprintf("%d\x00%s\x00%s\x00%s", a.BookId, a.Type, locationAsString, a.Fingerprint)
+}
+
+func (s *MemoryStore) record(kind ChangeKind, book *Book, a *Annotation) {
+	c := Change{Kind: kind}
+	if book != nil {
+		stored := *book
+		c.Book = &stored
+	} else {
+		stored := *a
+		c.Annotation = &stored
+	}
+	s.changes = append(s.changes, c)
+}
+
+type memoryBookRepository struct {
+	store *MemoryStore
+}
+
+func (r *memoryBookRepository) UpsertBook(_ context.Context, book *Book) (existed bool, err error) {
+	if err := normalizeIsbn(book); err != nil {
+		return false, err
+	}
+	s := r.store
+	if existing := r.findBook(book); existing != nil {
+		mergeBook(existing, book, s.policies)
+		*existing = *book
+		s.record(Updated, book, nil)
+		return true, nil
+	}
+	s.lastBookId++
+	book.Id = s.lastBookId
+	stored := *book
+	s.books = append(s.books, &stored)
+	s.record(Inserted, book, nil)
+	return false, nil
+}
+
+// findBook matches the same way as findBook of the database repository: by ISBN, by name and then fuzzily
+func (r *memoryBookRepository) findBook(template *Book) *Book {
+	if template.Isbn != "" {
+		isbn10, _ := isbn.To10(template.Isbn)
+		for _, b := range r.store.books {
+			if b.Isbn == template.Isbn || (isbn10 != "" && b.Isbn == isbn10) {
+				return b
+			}
+		}
+	}
+	for _, b := range r.store.books {
+		if b.Name == template.Name && !differentIsbns(*b, *template) {
+			return b
+		}
+	}
+	for _, b := range r.store.books {
+		if SameBook(*b, *template) {
+			return b
+		}
+	}
+	return nil
+}
+
+type memoryAnnotationRepository struct {
+	store *MemoryStore
+}
+
+func (r *memoryAnnotationRepository) UpsertAnnotation(_ context.Context, a *Annotation) (existed bool, err error) {
+	a.Fingerprint = Fingerprint(a.Text)
+	s := r.store
+	if existing := r.findAnnotation(a); existing != nil {
+		// fingerprint changes with the text, so the annotation has to be indexed again
+		s.unindex(existing)
+		mergeAnnotation(existing, a, s.policies)
+		*existing = *a
+		s.index(existing)
+		s.record(Updated, nil, a)
+		return true, nil
+	}
+	s.lastAnnotationId++
+	a.Id = s.lastAnnotationId
+	stored := *a
+	s.index(&stored)
+	s.record(Inserted, nil, a)
+	return false, nil
+}
+
+// findAnnotation matches the same way as findAnnotation of the database repository
+func (r *memoryAnnotationRepository) findAnnotation(template *Annotation) *Annotation {
+	if template.ExternalId != "" {
+		if a, ok := r.store.byExternalId[externalIdKey(template)]; ok {
+			return a
+		}
+	}
+	return r.store.byFingerprint[fingerprintKey(template)]
+}
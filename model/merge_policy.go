@@ -0,0 +1,339 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MergePolicy tells which value of a field is kept when an incoming record matches an existing one
+type MergePolicy string
+
+const (
+	// PreferExisting keeps the existing value, unless it is empty
+	PreferExisting MergePolicy = "prefer-existing"
+	// PreferIncoming always takes the incoming value, even an empty one
+	PreferIncoming MergePolicy = "prefer-incoming"
+	// PreferNonEmpty takes the incoming value, unless it is empty
+	PreferNonEmpty MergePolicy = "prefer-non-empty"
+	// PreferNewestTimestamp takes the value of the annotation with the newer timestamp (incoming one on a tie)
+	PreferNewestTimestamp MergePolicy = "prefer-newest-timestamp"
+	// PreferLongerText takes the longer value (existing one on a tie)
+	PreferLongerText MergePolicy = "prefer-longer-text"
+)
+
+var mergePolicies = []MergePolicy{PreferExisting, PreferIncoming, PreferNonEmpty, PreferNewestTimestamp, PreferLongerText}
+
+// fields which can be merged by a policy; chapter is merged as a whole, as well as external identifier
+// together with its source, and fingerprint always follows the text
+const (
+	FieldLocation    = "location"
+	FieldText        = "text"
+	FieldTs          = "ts"
+	FieldOrigin      = "origin"
+	FieldType        = "type"
+	FieldChapter     = "chapter"
+	FieldExternalId  = "external_id"
+	FieldBookName    = "book.name"
+	FieldBookIsbn    = "book.isbn"
+	FieldBookAuthors = "book.authors"
+)
+
+// defaultMergePolicies take what the source tells now, except for the book: its name and ISBN don't change
+// depending on which source saw it last, and the longer list of authors is usually the complete one
+var defaultMergePolicies = map[string]MergePolicy{
+	FieldLocation:    PreferNonEmpty,
+	FieldText:        PreferNonEmpty,
+	FieldTs:          PreferNonEmpty,
+	FieldOrigin:      PreferNonEmpty,
+	FieldType:        PreferNonEmpty,
+	FieldChapter:     PreferNonEmpty,
+	FieldExternalId:  PreferNonEmpty,
+	FieldBookName:    PreferExisting,
+	FieldBookIsbn:    PreferExisting,
+	FieldBookAuthors: PreferLongerText,
+}
+
+// MergePolicies are merge policies of all fields, set globally or for a single source.
+// It can be used as a flag, each value being [source:]field=policy
+type MergePolicies struct {
+	global   map[string]MergePolicy
+	bySource map[string]map[string]MergePolicy
+}
+
+func DefaultMergePolicies() *MergePolicies {
+	p := &MergePolicies{
+		global:   make(map[string]MergePolicy),
+		bySource: make(map[string]map[string]MergePolicy),
+	}
+	for field, policy := range defaultMergePolicies {
+		p.global[field] = policy
+	}
+	return p
+}
+
+// Set sets the policy of a field from a [source:]field=policy definition
+func (p *MergePolicies) Set(definition string) error {
+	target, value, ok := strings.Cut(definition, "=")
+	if !ok {
+		return fmt.Errorf("merge policy has to be defined as [source:]field=policy, not %q", definition)
+	}
+	source, field, ok := strings.Cut(target, ":")
+	if !ok {
+		source, field = "", target
+	}
+	if _, ok := defaultMergePolicies[field]; !ok {
+		return fmt.Errorf("unknown field %q, known fields are %v", field, mergeableFields())
+	}
+	policy := MergePolicy(value)
+	known := false
+	for _, m := range mergePolicies {
+		known = known || m == policy
+	}
+	if !known {
+		return fmt.Errorf("unknown merge policy %q, known policies are %v", value, mergePolicies)
+	}
+	if policy == PreferNewestTimestamp && strings.HasPrefix(field, "book.") {
+		return fmt.Errorf("books have no timestamp, so %v can't be used for %v", policy, field)
+	}
+	if policy == PreferLongerText && field == FieldTs {
+		return fmt.Errorf("%v can't be used for %v", policy, field)
+	}
+	if source == "" {
+		p.global[field] = policy
+		return nil
+	}
+	if p.bySource[source] == nil {
+		p.bySource[source] = make(map[string]MergePolicy)
+	}
+	p.bySource[source][field] = policy
+	return nil
+}
+
+func (p *MergePolicies) String() string {
+	if p == nil {
+		return ""
+	}
+	var definitions []string
+	for field, policy := range p.global {
+		definitions = append(definitions, field+"="+string(policy))
+	}
+	for source, policies := range p.bySource {
+		for field, policy := range policies {
+			definitions = append(definitions, source+":"+field+"="+string(policy))
+		}
+	}
+	sort.Strings(definitions)
+	return strings.Join(definitions, ",")
+}
+
+// Policy returns the policy of the field for records of the source; nil policies are the default ones
+func (p *MergePolicies) Policy(source string, field string) MergePolicy {
+	if p == nil {
+		return defaultMergePolicies[field]
+	}
+	if policy, ok := p.bySource[source][field]; ok {
+		return policy
+	}
+	return p.global[field]
+}
+
+func mergeableFields() []string {
+	var fields []string
+	for field := range defaultMergePolicies {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// takeIncoming decides by the policy if the incoming value replaces the existing one
+func takeIncoming(policy MergePolicy, existingEmpty bool, incomingEmpty bool, existingLength int, incomingLength int,
+	existingTs time.Time, incomingTs time.Time) bool {
+	switch policy {
+	case PreferExisting:
+		return existingEmpty
+	case PreferIncoming:
+		return true
+	case PreferNewestTimestamp:
+		return !incomingTs.Before(existingTs)
+	case PreferLongerText:
+		return incomingLength > existingLength
+	default:
+		return !incomingEmpty
+	}
+}
+
+// takeIncomingSQL is takeIncoming as an SQL condition of an upsert, given the emptiness and length of the
+// column(s) in the form of templates where %[1]s is replaced with the table alias
+func takeIncomingSQL(policy MergePolicy, empty string, length string) string {
+	existingEmpty, incomingEmpty := fmt.Sprintf(empty, "annotation"), fmt.Sprintf(empty, "excluded")
+	switch policy {
+	case PreferExisting:
+		return existingEmpty
+	case PreferIncoming:
+		return "1=1"
+	case PreferNewestTimestamp:
+		return "coalesce(excluded.ts >= annotation.ts, 1=1)"
+	case PreferLongerText:
+		return fmt.Sprintf(length, "excluded") + " > " + fmt.Sprintf(length, "annotation")
+	default:
+		return "not (" + incomingEmpty + ")"
+	}
+}
+
+// noTimestamp is the latest time which is considered to be a missing timestamp
+var noTimestamp = time.Date(1970, 1, 2, 0, 0, 0, 0, time.UTC)
+
+func tsIsEmpty(t time.Time) bool {
+	return t.Before(noTimestamp)
+}
+
+// annotationMergeField describes how a field of an annotation is merged, both in Go and in the native upsert
+type annotationMergeField struct {
+	field string
+	// columns written together by the decision of the field's policy
+	columns []string
+	// SQL templates of emptiness and length of the field, where %[1]s is replaced with the table alias
+	emptySQL  string
+	lengthSQL string
+	empty     func(a *Annotation) bool
+	length    func(a *Annotation) int
+	// keep puts the existing value of the field into the incoming annotation
+	keep func(existing *Annotation, a *Annotation)
+}
+
+var annotationMergeFields = []annotationMergeField{
+	{
+		field:     FieldLocation,
+		columns:   []string{"location"},
+		emptySQL:  "coalesce(cast(%[1]s.location as text), '') in ('', '{}')",
+		lengthSQL: "length(coalesce(cast(%[1]s.location as text), ''))",
+		empty:     func(a *Annotation) bool { return a.Location.IsEmpty() },
+		length: func(a *Annotation) int {
+			locationAsString, _ := json.Marshal(a.Location)
+			return len(locationAsString)
+		},
+		keep: func(existing *Annotation, a *Annotation) { a.Location = existing.Location },
+	},
+	{
+		field:     FieldText,
+		columns:   []string{"text", "fingerprint"},
+		emptySQL:  "coalesce(%[1]s.text, '') = ''",
+		lengthSQL: "length(coalesce(%[1]s.text, ''))",
+		empty:     func(a *Annotation) bool { return a.Text == "" },
+		length:    func(a *Annotation) int { return utf8.RuneCountInString(a.Text) },
+		keep: func(existing *Annotation, a *Annotation) {
+			a.Text = existing.Text
+			a.Fingerprint = existing.Fingerprint
+		},
+	},
+	{
+		field:     FieldTs,
+		columns:   []string{"ts"},
+		emptySQL:  "(%[1]s.ts is null or %[1]s.ts < '1970-01-02')",
+		lengthSQL: "0",
+		empty:     func(a *Annotation) bool { return tsIsEmpty(a.Ts) },
+		length:    func(a *Annotation) int { return 0 },
+		keep:      func(existing *Annotation, a *Annotation) { a.Ts = existing.Ts },
+	},
+	{
+		field:     FieldOrigin,
+		columns:   []string{"origin"},
+		emptySQL:  "coalesce(%[1]s.origin, '') = ''",
+		lengthSQL: "length(coalesce(%[1]s.origin, ''))",
+		empty:     func(a *Annotation) bool { return a.Origin == "" },
+		length:    func(a *Annotation) int { return utf8.RuneCountInString(a.Origin) },
+		keep:      func(existing *Annotation, a *Annotation) { a.Origin = existing.Origin },
+	},
+	{
+		field:     FieldType,
+		columns:   []string{"type"},
+		emptySQL:  "coalesce(%[1]s.type, '') = ''",
+		lengthSQL: "length(coalesce(%[1]s.type, ''))",
+		empty:     func(a *Annotation) bool { return a.Type == "" },
+		length:    func(a *Annotation) int { return utf8.RuneCountInString(string(a.Type)) },
+		keep:      func(existing *Annotation, a *Annotation) { a.Type = existing.Type },
+	},
+	{
+		field:     FieldChapter,
+		columns:   []string{"chapter_title", "chapter_url", "chapter_ordinal"},
+		emptySQL:  "(coalesce(%[1]s.chapter_title, '') = '' and coalesce(%[1]s.chapter_url, '') = '' and %[1]s.chapter_ordinal is null)",
+		lengthSQL: "length(coalesce(%[1]s.chapter_title, ''))",
+		empty:     func(a *Annotation) bool { return a.Chapter.IsEmpty() },
+		length:    func(a *Annotation) int { return utf8.RuneCountInString(a.Chapter.Title) },
+		keep:      func(existing *Annotation, a *Annotation) { a.Chapter = existing.Chapter },
+	},
+	{
+		// external identifier is meaningful only together with the source which issued it
+		field:     FieldExternalId,
+		columns:   []string{"source", "external_id"},
+		emptySQL:  "%[1]s.external_id is null",
+		lengthSQL: "length(coalesce(%[1]s.external_id, ''))",
+		empty:     func(a *Annotation) bool { return a.ExternalId == "" },
+		length:    func(a *Annotation) int { return utf8.RuneCountInString(a.ExternalId) },
+		keep: func(existing *Annotation, a *Annotation) {
+			a.Source = existing.Source
+			a.ExternalId = existing.ExternalId
+		},
+	},
+}
+
+// mergeAnnotation merges the existing annotation into the incoming one, field by field, by the policies
+// of the incoming annotation's source
+func mergeAnnotation(existing *Annotation, a *Annotation, policies *MergePolicies) {
+	a.Id = existing.Id
+	// decisions are made on the values as they came, even if a field deciding another one was merged already
+	incoming := *a
+	for _, f := range annotationMergeFields {
+		if !takeIncoming(policies.Policy(incoming.Source, f.field), f.empty(existing), f.empty(&incoming),
+			f.length(existing), f.length(&incoming), existing.Ts, incoming.Ts) {
+			f.keep(existing, a)
+		}
+	}
+	a.CreatedByRun = existing.CreatedByRun
+	if a.UpdatedByRun == 0 {
+		a.UpdatedByRun = existing.UpdatedByRun
+	}
+}
+
+// annotationUpsertMerge is mergeAnnotation expressed in SQL, for the native upsert of annotations of the source
+func annotationUpsertMerge(policies *MergePolicies, source string) string {
+	var assignments []string
+	for _, f := range annotationMergeFields {
+		condition := takeIncomingSQL(policies.Policy(source, f.field), f.emptySQL, f.lengthSQL)
+		for _, column := range f.columns {
+			assignments = append(assignments, fmt.Sprintf("%[1]s = case when %[2]s then excluded.%[1]s else annotation.%[1]s end", column, condition))
+		}
+	}
+	assignments = append(assignments,
+		"updated_by_run = coalesce(excluded.updated_by_run, annotation.updated_by_run)",
+		"change_cause = excluded.change_cause",
+		// annotation which is written again is back at its source
+		"deleted_at = null")
+	return "\n\t" + strings.Join(assignments, ",\n\t") + "\n"
+}
+
+var bookMergeFields = []struct {
+	field string
+	value func(b *Book) *string
+}{
+	{FieldBookName, func(b *Book) *string { return &b.Name }},
+	{FieldBookIsbn, func(b *Book) *string { return &b.Isbn }},
+	{FieldBookAuthors, func(b *Book) *string { return &b.Authors }},
+}
+
+// mergeBook merges the existing book into the incoming one, field by field, by the policies of the incoming book's source
+func mergeBook(existing *Book, book *Book, policies *MergePolicies) {
+	book.Id = existing.Id
+	for _, f := range bookMergeFields {
+		existingValue, incomingValue := *f.value(existing), *f.value(book)
+		if !takeIncoming(policies.Policy(book.Source, f.field), existingValue == "", incomingValue == "",
+			utf8.RuneCountInString(existingValue), utf8.RuneCountInString(incomingValue), time.Time{}, time.Time{}) {
+			*f.value(book) = existingValue
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/isbn"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+type Migration struct {
+	Version     int
+	Description string
+	up          func(ctx context.Context, tx querier, d dialect) error
+}
+
+// migrations are applied in order, each one in its own transaction; never change an already released migration,
+// add a new one instead. Migrations must tolerate databases created before schema versioning was introduced.
+// Statements are written for SQLite, DDL which PostgreSQL does not understand is written for both
+var migrations = []Migration{
+	{1, "create book and annotation tables", func(ctx context.Context, tx querier, d dialect) error {
+		if d == postgresDialect {
+			_, err := tx.ExecContext(ctx, `
+	create table if not exists book (
+		Id bigserial not null primary key,
+		isbn text,
+		name text,
+		authors text
+	);
+	create index if not exists book_name on book(name);
+	create index if not exists book_isbn_name on book(isbn);
+	create table if not exists annotation (
+		Id bigserial not null primary key,
+		book_id bigint references book (Id),
+		text text,
+		location text,
+		ts timestamp with time zone,
+		origin text,
+		type text
+	);
+	create index if not exists annotation_text on annotation(book_id, text);
+	`)
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+	create table if not exists book (
+		Id integer not null primary key,
+		isbn text,
+		name text,
+		authors text
+	);
+    create index if not exists book_name on book(name);
+	create index if not exists book_isbn_name on book(isbn);
+	create table if not exists annotation (
+		Id integer not null primary key,
+		book_id integer,
+		text text,
+		location text,
+		ts timestamp,
+		origin text,
+		type text,
+    FOREIGN KEY (book_id)
+       REFERENCES book (id)
+	);
+    create index if not exists annotation_text on annotation(book_id, text);
+	`)
+		return err
+	}},
+	{2, "add chapter to annotation", func(ctx context.Context, tx querier, d dialect) error {
+		return addColumns(ctx, tx, d, "annotation", "chapter_title text", "chapter_url text", "chapter_ordinal integer")
+	}},
+	{3, "add source and external id to annotation", func(ctx context.Context, tx querier, d dialect) error {
+		if err := addColumns(ctx, tx, d, "annotation", "source text", "external_id text"); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "create unique index if not exists annotation_external_id on annotation(source, external_id) where external_id is not null")
+		return err
+	}},
+	{4, "normalize book ISBNs to ISBN-13", normalizeIsbns},
+	{5, "add text fingerprint to annotation", func(ctx context.Context, tx querier, d dialect) error {
+		if err := addColumns(ctx, tx, d, "annotation", "fingerprint text"); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "create index if not exists annotation_fingerprint on annotation(book_id, fingerprint)"); err != nil {
+			return err
+		}
+		return backfillFingerprints(ctx, tx)
+	}},
+	{6, "make annotation fingerprint unique per book, type and location", func(ctx context.Context, tx querier, d dialect) error {
+		// the unique index does not allow the same annotation exported again, so it is merged into the oldest one
+		if err := locationsAsText(ctx, tx, d, "annotation"); err != nil {
+			return err
+		}
+		if err := mergeDuplicateAnnotations(ctx, tx); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+	drop index if exists annotation_fingerprint;
+	`+annotationFingerprintIndex)
+		return err
+	}},
+	{7, "create ingestion checkpoint table", func(ctx context.Context, tx querier, d dialect) error {
+		_, err := tx.ExecContext(ctx, `
+	create table if not exists ingestion_checkpoint (
+		origin text not null primary key,
+		records integer,
+		hash text,
+		updated_at `+d.timestampType()+`
+	);
+	`)
+		return err
+	}},
+	{8, "create import run table and link annotations to import runs", func(ctx context.Context, tx querier, d dialect) error {
+		_, err := tx.ExecContext(ctx, `
+	create table if not exists import_run (
+		`+d.idColumn()+`,
+		source text,
+		origin text,
+		content_hash text,
+		started_at `+d.timestampType()+`,
+		finished_at `+d.timestampType()+`,
+		tool_version text,
+		inserted integer,
+		updated integer,
+		failed integer
+	);
+	`)
+		if err != nil {
+			return err
+		}
+		return addColumns(ctx, tx, d, "annotation", "created_by_run bigint references import_run(Id)", "updated_by_run bigint references import_run(Id)")
+	}},
+	{9, "track what import runs overwrote, so that they can be reverted", func(ctx context.Context, tx querier, d dialect) error {
+		if err := addColumns(ctx, tx, d, "book", "created_by_run bigint references import_run(Id)", "updated_by_run bigint references import_run(Id)"); err != nil {
+			return err
+		}
+		if err := addColumns(ctx, tx, d, "import_run", "reverted_at "+d.timestampType()); err != nil {
+			return err
+		}
+		// rows as they were before the run wrote to them for the first time
+		_, err := tx.ExecContext(ctx, `
+	create table if not exists book_before_run (
+		run_id bigint not null references import_run(Id),
+		book_id bigint not null,
+		isbn text,
+		name text,
+		authors text,
+		updated_by_run bigint,
+		primary key (run_id, book_id)
+	);
+	create table if not exists annotation_before_run (
+		run_id bigint not null references import_run(Id),
+		annotation_id bigint not null,
+		book_id bigint,
+		text text,
+		location text,
+		ts `+d.timestampType()+`,
+		origin text,
+		type text,
+		chapter_title text,
+		chapter_url text,
+		chapter_ordinal integer,
+		source text,
+		external_id text,
+		fingerprint text,
+		updated_by_run bigint,
+		primary key (run_id, annotation_id)
+	);
+	`)
+		return err
+	}},
+	{10, "record history of annotation changes", func(ctx context.Context, tx querier, d dialect) error {
+		// writers set change_cause together with the change, triggers copy it into the history
+		if err := addColumns(ctx, tx, d, "annotation", "change_cause text"); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+	create table if not exists annotation_history (
+		`+d.idColumn()+`,
+		annotation_id bigint not null,
+		changed_at `+d.timestampType()+`,
+		cause text,
+		field text,
+		old_value text,
+		new_value text
+	);
+	create index if not exists annotation_history_annotation on annotation_history(annotation_id);
+	`)
+		if err != nil {
+			return err
+		}
+		if d == postgresDialect {
+			_, err = tx.ExecContext(ctx, postgresAnnotationHistoryTriggers(annotationHistoryFields))
+		} else {
+			_, err = tx.ExecContext(ctx, sqliteAnnotationHistoryTriggers(annotationHistoryFields))
+		}
+		return err
+	}},
+	{11, "soft-delete annotations missing from their source", func(ctx context.Context, tx querier, d dialect) error {
+		if err := addColumns(ctx, tx, d, "annotation", "deleted_at "+d.timestampType()); err != nil {
+			return err
+		}
+		if err := addColumns(ctx, tx, d, "annotation_before_run", "deleted_at "+d.timestampType()); err != nil {
+			return err
+		}
+		if d == postgresDialect {
+			_, err := tx.ExecContext(ctx, postgresAnnotationHistoryTriggers(annotationHistoryFieldsWithDeletion))
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+	drop trigger if exists annotation_history_insert;
+	drop trigger if exists annotation_history_update;
+	drop trigger if exists annotation_history_delete;
+	`+sqliteAnnotationHistoryTriggers(annotationHistoryFieldsWithDeletion))
+		return err
+	}},
+	{12, "full-text search index of annotations", func(ctx context.Context, tx querier, d dialect) error {
+		// PostgreSQL has no FTS5, search is not supported there
+		if d == postgresDialect {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, annotationFts)
+		return err
+	}},
+	{13, "add normalized name to book, to find similar books without reading all of them", func(ctx context.Context, tx querier, d dialect) error {
+		for _, table := range []string{"book", "book_before_run"} {
+			if err := addColumns(ctx, tx, d, table, "normalized_name text"); err != nil {
+				return err
+			}
+			if err := backfillNormalizedNames(ctx, tx, table); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, "create index if not exists book_normalized_name on book(normalized_name)")
+		return err
+	}},
+	{14, "add account to import run, to reconcile exports of an account whatever their file names", func(ctx context.Context, tx querier, d dialect) error {
+		return addColumns(ctx, tx, d, "import_run", "account text not null default ''")
+	}},
+}
+
+// annotationFingerprintIndex is the upsert target of annotations without an external identifier; annotations with one
+// are unique by it, so the same text can appear more than once in a book, like in an O'Reilly export
+const annotationFingerprintIndex = `
+	create unique index if not exists annotation_fingerprint_key on annotation(book_id, type, location, fingerprint) where external_id is null;
+`
+
+// TargetSchemaVersion is the version of the schema after all known migrations are applied
+func TargetSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// ErrUnversioned is returned for a database without the schema_version table, like a new one or one created
+// before schema versioning
+var ErrUnversioned = errors.New("database schema is not versioned")
+
+// SchemaVersion returns the version of the last migration applied to the database, without changing the database
+func SchemaVersion(ctx context.Context, db *sql.DB) (version int, err error) {
+	versioned, err := schemaVersionTableExists(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	if !versioned {
+		return 0, ErrUnversioned
+	}
+	var v sql.NullInt64
+	if err := db.QueryRowContext(ctx, "select max(version) from schema_version").Scan(&v); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return int(v.Int64), nil
+}
+
+// PendingMigrations returns migrations which are not yet applied to the database, all of them if it is unversioned
+func PendingMigrations(ctx context.Context, db *sql.DB) (pending []Migration, err error) {
+	current, err := SchemaVersion(ctx, db)
+	if err != nil && !errors.Is(err, ErrUnversioned) {
+		return nil, err
+	}
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate brings the database schema up to TargetSchemaVersion
+func Migrate(ctx context.Context, db *sql.DB) error {
+	if err := ensureSchemaVersionTable(ctx, db); err != nil {
+		return err
+	}
+	pending, err := PendingMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		applied, err := applyMigration(ctx, db, m)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		if applied {
+			log.Infof("Applied schema migration %d: %s", m.Version, m.Description)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies the migration, unless another process applied it since the pending migrations were read
+func applyMigration(ctx context.Context, db *sql.DB, m Migration) (applied bool, err error) {
+	d := dialectOf(db)
+	err = inTransaction(ctx, db, func(tx querier) error {
+		if err := lockMigrations(ctx, tx, d); err != nil {
+			return err
+		}
+		var count int
+		if err := tx.QueryRowContext(ctx, "select count(*) from schema_version where version=?", m.Version).Scan(&count); err != nil {
+			return fmt.Errorf("failed to read schema version: %w", err)
+		}
+		if count > 0 {
+			return nil
+		}
+		if err := m.up(ctx, tx, d); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "insert into schema_version(version, description, applied_at) values(?,?,?)", m.Version, m.Description, time.Now().UTC())
+		applied = err == nil
+		return err
+	})
+	return applied, err
+}
+
+// migrationLockKey identifies the advisory lock of migrations within a PostgreSQL database
+const migrationLockKey = 0x7474_6d69_6772_6174
+
+// lockMigrations makes processes migrating a shared PostgreSQL database at the same time (like the first runs after
+// an upgrade) wait for each other until the end of the transaction; SQLite allows a single writer anyway
+func lockMigrations(ctx context.Context, tx querier, d dialect) error {
+	if d != postgresDialect {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "select pg_advisory_xact_lock(?)", int64(migrationLockKey)); err != nil {
+		return fmt.Errorf("failed to lock the schema for migration: %w", err)
+	}
+	return nil
+}
+
+func schemaVersionTableExists(ctx context.Context, db *sql.DB) (bool, error) {
+	query := "select count(*) from sqlite_master where type='table' and name='schema_version'"
+	if dialectOf(db) == postgresDialect {
+		query = "select count(*) from information_schema.tables where table_schema=current_schema() and table_name='schema_version'"
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return count > 0, nil
+}
+
+func ensureSchemaVersionTable(ctx context.Context, db *sql.DB) error {
+	d := dialectOf(db)
+	err := inTransaction(ctx, db, func(tx querier) error {
+		if err := lockMigrations(ctx, tx, d); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+	create table if not exists schema_version (
+		version integer not null primary key,
+		description text,
+		applied_at `+d.timestampType()+`
+	);
+	`)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+	return nil
+}
+
+// addColumns adds only the columns which don't exist yet, since databases created before schema versioning
+// might already have some of them
+func addColumns(ctx context.Context, tx querier, d dialect, table string, columnDefinitions ...string) error {
+	if d == postgresDialect {
+		for _, definition := range columnDefinitions {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("alter table %s add column if not exists %s", table, definition)); err != nil {
+				return fmt.Errorf("failed to add column %v to table %v: %w", definition, table, err)
+			}
+		}
+		return nil
+	}
+	columns, err := queryStrings(ctx, tx, fmt.Sprintf("select name from pragma_table_info('%s')", table))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of table %v: %w", table, err)
+	}
+	existing := make(map[string]bool)
+	for _, name := range columns {
+		existing[name] = true
+	}
+	for _, definition := range columnDefinitions {
+		var name string
+		_, _ = fmt.Sscan(definition, &name)
+		if existing[name] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("alter table %s add column %s", table, definition)); err != nil {
+			return fmt.Errorf("failed to add column %v to table %v: %w", name, table, err)
+		}
+	}
+	return nil
+}
+
+func normalizeIsbns(ctx context.Context, tx querier, _ dialect) error {
+	values, err := queryStrings(ctx, tx, "select distinct isbn from book where isbn is not null and isbn != ''")
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		normalized, err := isbn.Normalize(value)
+		if err != nil {
+			log.Warnf("Leaving invalid ISBN as is: %v", err)
+			continue
+		}
+		if normalized == value {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "update book set isbn=? where isbn=?", normalized, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// locationsAsText converts locations stored as BLOB by the first versions, since SQLite never finds a BLOB equal to
+// the same location written as text, and so the annotation would not be matched when it is ingested again
+func locationsAsText(ctx context.Context, tx querier, d dialect, table string) error {
+	if d == postgresDialect {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "update "+table+" set location=cast(location as text) where typeof(location)='blob'"); err != nil {
+		return fmt.Errorf("failed to convert locations of %v to text: %w", table, err)
+	}
+	return nil
+}
+
+// mergeDuplicateAnnotations merges annotations with the same fingerprint, type and location in the same book into the oldest
+// of them, filling in the chapter and source the oldest one does not have; every merged annotation is logged
+func mergeDuplicateAnnotations(ctx context.Context, tx querier) error {
+	duplicates, err := findDuplicateAnnotations(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("failed to find annotations duplicated by text fingerprint: %w", err)
+	}
+	for _, duplicate := range duplicates {
+		_, err := tx.ExecContext(ctx, `
+	update annotation set
+		chapter_title=coalesce(nullif(chapter_title, ''), ?), chapter_url=coalesce(nullif(chapter_url, ''), ?),
+		chapter_ordinal=coalesce(chapter_ordinal, ?), source=coalesce(nullif(source, ''), ?)
+	where Id=?`, duplicate.chapterTitle, duplicate.chapterUrl, duplicate.chapterOrdinal, duplicate.source, duplicate.survivor)
+		if err != nil {
+			return fmt.Errorf("failed to merge annotation %v into %v: %w", duplicate.id, duplicate.survivor, err)
+		}
+		if _, err := tx.ExecContext(ctx, "delete from annotation where Id=?", duplicate.id); err != nil {
+			return fmt.Errorf("failed to merge annotation %v into %v: %w", duplicate.id, duplicate.survivor, err)
+		}
+		log.Warnf("Merged annotation %d into annotation %d, they have the same text, type and location: %q", duplicate.id, duplicate.survivor, duplicate.text.String)
+	}
+	return nil
+}
+
+type duplicateAnnotation struct {
+	id, survivor                   int64
+	text, chapterTitle, chapterUrl sql.NullString
+	source                         sql.NullString
+	chapterOrdinal                 sql.NullInt64
+}
+
+func findDuplicateAnnotations(ctx context.Context, tx querier) (duplicates []duplicateAnnotation, err error) {
+	rows, err := tx.QueryContext(ctx, `
+	select Id, book_id, type, location, fingerprint, text, chapter_title, chapter_url, chapter_ordinal, source from annotation
+	where external_id is null and book_id is not null and type is not null and location is not null and fingerprint is not null
+	order by Id`)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.SafeClose(rows, &err)
+	survivors := make(map[string]int64)
+	for rows.Next() {
+		var d duplicateAnnotation
+		var bookId int64
+		var annotationType, location, fingerprint string
+		if err := rows.Scan(&d.id, &bookId, &annotationType, &location, &fingerprint, &d.text, &d.chapterTitle, &d.chapterUrl,
+			&d.chapterOrdinal, &d.source); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("%d\x00%s\x00%s\x00%s", bookId, annotationType, location, fingerprint)
+		if survivor, ok := survivors[key]; ok {
+			d.survivor = survivor
+			duplicates = append(duplicates, d)
+			continue
+		}
+		survivors[key] = d.id
+	}
+	return duplicates, rows.Err()
+}
+
+func backfillNormalizedNames(ctx context.Context, tx querier, table string) error {
+	names, err := queryStrings(ctx, tx, "select distinct coalesce(name, '') from "+table)
+	if err != nil {
+		return fmt.Errorf("failed to read book names of %v: %w", table, err)
+	}
+	for _, name := range names {
+		if _, err := tx.ExecContext(ctx, "update "+table+" set normalized_name=? where name=?", NormalizeTitle(name), name); err != nil {
+			return fmt.Errorf("failed to normalize book names of %v: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func backfillFingerprints(ctx context.Context, tx querier) error {
+	fingerprints, err := readFingerprints(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for id, fingerprint := range fingerprints {
+		if _, err := tx.ExecContext(ctx, "update annotation set fingerprint=? where Id=?", fingerprint, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFingerprints(ctx context.Context, tx querier) (fingerprints map[int64]string, err error) {
+	rows, err := tx.QueryContext(ctx, "select Id, text from annotation where fingerprint is null")
+	if err != nil {
+		return nil, err
+	}
+	defer utils.SafeClose(rows, &err)
+	fingerprints = make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var text sql.NullString
+		if err := rows.Scan(&id, &text); err != nil {
+			return nil, err
+		}
+		fingerprints[id] = Fingerprint(text.String)
+	}
+	return fingerprints, rows.Err()
+}
+
+func queryStrings(ctx context.Context, tx querier, query string) (values []string, err error) {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.SafeClose(rows, &err)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,165 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentMigrate(t *testing.T) {
+	db := openPostgresTestDatabase(t, false)
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = Migrate(ctx, db)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var applied int
+	if err := db.QueryRowContext(ctx, "select count(*) from schema_version").Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("expected every migration to be applied once, %d were applied", applied)
+	}
+}
+
+// baselineSchema is the schema of databases created before schema versioning, locations were stored as BLOBs
+const baselineSchema = `
+	create table book (
+		Id integer not null primary key,
+		isbn text,
+		name text,
+		authors text
+	);
+	create index book_name on book(name);
+	create table annotation (
+		Id integer not null primary key,
+		book_id integer,
+		text text,
+		location text,
+		ts timestamp,
+		origin text,
+		type text,
+		foreign key (book_id) references book (id)
+	);
+	create index annotation_text on annotation(book_id, text);
+`
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup []string
+		check func(t *testing.T, db *sql.DB)
+	}{
+		{
+			name: "empty database",
+		},
+		{
+			name: "ISBN-10 of a baseline database",
+			setup: []string{
+				baselineSchema,
+				"insert into book(Id, isbn, name, authors) values(1, '0-306-40615-2', 'The Book', 'Author'), (2, 'not an ISBN', 'Other Book', '')",
+			},
+			check: func(t *testing.T, db *sql.DB) {
+				isbns, err := queryStrings(context.Background(), db, "select coalesce(isbn, '') from book order by Id")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(isbns, []string{"9780306406157", "not an ISBN"}) {
+					t.Errorf("expected only the valid ISBN to be normalized, got %v", isbns)
+				}
+				names, err := queryStrings(context.Background(), db, "select normalized_name from book order by Id")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(names, []string{NormalizeTitle("The Book"), NormalizeTitle("Other Book")}) {
+					t.Errorf("expected normalized names to be filled in, got %v", names)
+				}
+			},
+		},
+		{
+			name: "duplicate annotations of a baseline database",
+			setup: []string{
+				baselineSchema,
+				"insert into book(Id, isbn, name, authors) values(1, '', 'The Book', 'Author')",
+				// same text with different quotes at the same location, and the same note elsewhere
+				`insert into annotation(Id, book_id, text, location, ts, origin, type) values
+					(1, 1, 'It''s important.', cast('{"locationStart":10}' as blob), '2022-01-01 10:00:00', 'a.txt', 'highlight'),
+					(2, 1, 'It’s important', cast('{"locationStart":10}' as blob), '2022-01-02 10:00:00', 'b.txt', 'highlight'),
+					(3, 1, 'It''s important.', cast('{"locationStart":400}' as blob), '2022-01-03 10:00:00', 'a.txt', 'highlight'),
+					(4, 1, 'It''s important.', cast('{"locationStart":10}' as blob), '2022-01-04 10:00:00', 'a.txt', 'note')`,
+			},
+			check: func(t *testing.T, db *sql.DB) {
+				ids, err := queryStrings(context.Background(), db, "select cast(Id as text) || ':' || typeof(location) from annotation order by Id")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(ids, []string{"1:text", "3:text", "4:text"}) {
+					t.Errorf("expected only the duplicate at the same location and of the same type to be merged, got %v", ids)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := openEmptyTestDatabase(t)
+			for _, statement := range tt.setup {
+				if _, err := db.ExecContext(ctx, statement); err != nil {
+					t.Fatalf("failed to set up the database: %v", err)
+				}
+			}
+			// migrating again has nothing to do
+			for i := 0; i < 2; i++ {
+				if err := Migrate(ctx, db); err != nil {
+					t.Fatal(err)
+				}
+			}
+			version, err := SchemaVersion(ctx, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending, err := PendingMigrations(ctx, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != TargetSchemaVersion() || len(pending) != 0 {
+				t.Errorf("expected schema version %d without pending migrations, got %d and %v", TargetSchemaVersion(), version, pending)
+			}
+			if tt.check != nil {
+				tt.check(t, db)
+			}
+		})
+	}
+}
+
+func TestSchemaVersionOfUnversionedDatabase(t *testing.T) {
+	ctx := context.Background()
+	db := openEmptyTestDatabase(t)
+	if _, err := SchemaVersion(ctx, db); !errors.Is(err, ErrUnversioned) {
+		t.Fatalf("expected an unversioned database, got %v", err)
+	}
+	pending, err := PendingMigrations(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(migrations) {
+		t.Errorf("expected all migrations to be pending, got %v", pending)
+	}
+	if exists, err := schemaVersionTableExists(ctx, db); err != nil || exists {
+		t.Errorf("expected reading the schema version not to create the schema_version table, got %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// querier is implemented both by *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// inTransaction commits if f succeeds, otherwise rolls back and returns the error of f;
+// tx given to f accepts statements written for SQLite whatever the database is
+func inTransaction(ctx context.Context, db *sql.DB, f func(tx querier) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := f(bind(tx, dialectOf(db))); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/isbn"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Filter is a parsed query of the annotation query language, like
+//
+//	book:"Designing Data" type:note after:2022-01-01 tag:architecture source:oreilly -origin:old.txt replication
+//
+// Terms are field:value pairs (value can be quoted) combined with AND, a term prefixed with - is negated
+// and a term without a field matches the text of annotations
+type Filter struct {
+	terms []filterTerm
+}
+
+type filterTerm struct {
+	field   string
+	value   string
+	negated bool
+}
+
+// filterFields compile a value of a field into an SQL condition on the annotation table
+var filterFields = map[string]func(value string) (condition string, args []interface{}, err error){
+	"text": func(value string) (string, []interface{}, error) {
+		return containsCondition("text"), []interface{}{containsPattern(value)}, nil
+	},
+	"book": func(value string) (string, []interface{}, error) {
+		return "book_id in (select Id from book where " + containsCondition("name") + ")", []interface{}{containsPattern(value)}, nil
+	},
+	"author": func(value string) (string, []interface{}, error) {
+		return "book_id in (select Id from book where " + containsCondition("authors") + ")", []interface{}{containsPattern(value)}, nil
+	},
+	"isbn": func(value string) (string, []interface{}, error) {
+		normalized, err := isbn.Normalize(value)
+		if err != nil {
+			return "", nil, err
+		}
+		// books stored before ISBN normalization might still have ISBN-10, which only 978 ISBNs have
+		if isbn10, ok := isbn.To10(normalized); ok {
+			return "book_id in (select Id from book where isbn=? or isbn=?)", []interface{}{normalized, isbn10}, nil
+		}
+		return "book_id in (select Id from book where isbn=?)", []interface{}{normalized}, nil
+	},
+	"tag": func(value string) (string, []interface{}, error) {
+		tag := strings.ToLower(strings.TrimPrefix(value, "#"))
+		if !tagRegex.MatchString(tag) {
+			return "", nil, fmt.Errorf("tag has to be letters, digits, _ and -")
+		}
+		return tagCondition(), append(tagSeparatorArgs(), "% #"+escapeLike(tag)+" %"), nil
+	},
+	"chapter": func(value string) (string, []interface{}, error) {
+		return containsCondition("chapter_title"), []interface{}{containsPattern(value)}, nil
+	},
+	"type": func(value string) (string, []interface{}, error) {
+		if value != string(Highlight) && value != string(Note) {
+			return "", nil, fmt.Errorf("type has to be %v or %v", Highlight, Note)
+		}
+		return "type=?", []interface{}{value}, nil
+	},
+	"source": func(value string) (string, []interface{}, error) {
+		return "coalesce(source, '')=?", []interface{}{value}, nil
+	},
+	"origin": func(value string) (string, []interface{}, error) {
+		return "coalesce(origin, '')=?", []interface{}{value}, nil
+	},
+	"after": func(value string) (string, []interface{}, error) {
+		t, err := parseFilterTime(value)
+		return "ts >= ?", []interface{}{t}, err
+	},
+	"before": func(value string) (string, []interface{}, error) {
+		t, err := parseFilterTime(value)
+		return "ts < ?", []interface{}{t}, err
+	},
+}
+
+// ParseFilter parses a query of the annotation query language, reporting unknown fields and invalid values
+func ParseFilter(query string) (*Filter, error) {
+	f := &Filter{}
+	tokens, err := splitFilterTerms(query)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		term := filterTerm{field: "text", value: token.text}
+		if strings.HasPrefix(term.value, "-") && !token.quoted {
+			term.negated = true
+			term.value = term.value[1:]
+		}
+		if field, value, ok := strings.Cut(term.value, ":"); ok && !token.quotedField {
+			term.field, term.value = strings.ToLower(field), value
+		}
+		compile, ok := filterFields[term.field]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown field %q, known fields are %v", ErrInvalidFilter, term.field, FilterFields())
+		}
+		if term.value == "" {
+			return nil, fmt.Errorf("%w: %v has no value", ErrInvalidFilter, term.field)
+		}
+		if _, _, err := compile(term.value); err != nil {
+			return nil, fmt.Errorf("%w: %v:%v: %v", ErrInvalidFilter, term.field, term.value, err)
+		}
+		f.terms = append(f.terms, term)
+	}
+	return f, nil
+}
+
+// FilterFields are the fields known to the query language
+func FilterFields() []string {
+	var fields []string
+	for field := range filterFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// sql compiles the filter into a condition on the annotation table, empty if the filter has no terms
+func (f *Filter) sql() (condition string, args []interface{}) {
+	var conditions []string
+	for _, term := range f.terms {
+		// values were validated by ParseFilter
+		c, a, _ := filterFields[term.field](term.value)
+		if term.negated {
+			c = "not (" + c + ")"
+		}
+		conditions = append(conditions, c)
+		args = append(args, a...)
+	}
+	return strings.Join(conditions, " and "), args
+}
+
+func (f *Filter) String() string {
+	var terms []string
+	for _, term := range f.terms {
+		s := term.field + ":" + term.value
+		if strings.IndexFunc(term.value, unicode.IsSpace) >= 0 {
+			s = term.field + `:"` + term.value + `"`
+		}
+		if term.negated {
+			s = "-" + s
+		}
+		terms = append(terms, s)
+	}
+	return strings.Join(terms, " ")
+}
+
+type filterToken struct {
+	text string
+	// quoted tells that the whole token was quoted, quotedField that the quote started before a colon
+	quoted      bool
+	quotedField bool
+}
+
+// splitFilterTerms splits the query on whitespace outside of double quotes, removing the quotes
+func splitFilterTerms(query string) (tokens []filterToken, err error) {
+	var current strings.Builder
+	var token filterToken
+	inToken, inQuotes := false, false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			if !inToken {
+				token.quoted = true
+			}
+			if !inQuotes && !strings.Contains(current.String(), ":") {
+				token.quotedField = true
+			}
+			inQuotes, inToken = !inQuotes, true
+		case unicode.IsSpace(r) && !inQuotes:
+			if inToken {
+				token.text = current.String()
+				tokens = append(tokens, token)
+			}
+			current.Reset()
+			token = filterToken{}
+			inToken = false
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("%w: unterminated quote in %q", ErrInvalidFilter, query)
+	}
+	if inToken {
+		token.text = current.String()
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func containsCondition(column string) string {
+	return "lower(coalesce(" + column + ", '')) like ? escape '\\'"
+}
+
+func containsPattern(value string) string {
+	return "%" + escapeLike(strings.ToLower(value)) + "%"
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// tags are hashtags in the text of annotations, like a note "#architecture, see chapter 3"; a tag starts after
+// a space and ends before a space or one of tagSeparators
+var (
+	tagRegex      = regexp.MustCompile(`^[\p{L}\p{N}_-]+$`)
+	tagSeparators = []string{"\n", "\r", "\t", ",", ".", ";", ":", "!", "?", "(", ")", `"`}
+)
+
+// tagCondition replaces the separators by spaces, so that a tag is surrounded by spaces; separators are arguments,
+// since SQLite and PostgreSQL write control characters differently
+func tagCondition() string {
+	text := "lower(coalesce(text, ''))"
+	for range tagSeparators {
+		text = "replace(" + text + ", ?, ' ')"
+	}
+	return "' ' || " + text + " || ' ' like ? escape '\\'"
+}
+
+func tagSeparatorArgs() []interface{} {
+	args := make([]interface{}, len(tagSeparators))
+	for i, s := range tagSeparators {
+		args[i] = s
+	}
+	return args
+}
+
+func parseFilterTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected a date like 2022-01-31 or a time like 2022-01-31T15:04:05Z")
+}
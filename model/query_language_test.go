@@ -0,0 +1,136 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		// want is the parsed filter written back as a query
+		want string
+		err  bool
+	}{
+		{query: "", want: ""},
+		{query: "replication", want: "text:replication"},
+		{query: `book:"Designing Data" type:note`, want: `book:"Designing Data" type:note`},
+		{query: "-origin:old.txt source:oreilly", want: "-origin:old.txt source:oreilly"},
+		{query: "BOOK:ddia", want: "book:ddia"},
+		{query: `"-not negated"`, want: `text:"-not negated"`},
+		{query: `"key:value" text`, want: "text:key:value text:text"},
+		{query: "after:2022-01-01 before:2022-02-01T10:00:00Z", want: "after:2022-01-01 before:2022-02-01T10:00:00Z"},
+		{query: "isbn:0-306-40615-2", want: "isbn:0-306-40615-2"},
+		{query: "  chapter:Intro   author:Kleppmann ", want: "chapter:Intro author:Kleppmann"},
+		{query: "tag:favorite", want: "tag:favorite"},
+		{query: "-tag:#event-sourcing", want: "-tag:#event-sourcing"},
+		{query: `tag:"two words"`, err: true},
+		{query: "color:red", err: true},
+		{query: "book:", err: true},
+		{query: "type:bookmark", err: true},
+		{query: "after:yesterday", err: true},
+		{query: "isbn:123", err: true},
+		{query: `book:"unterminated`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			f, err := ParseFilter(tt.query)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidFilter) {
+					t.Errorf("ParseFilter(%q) error = %v, expected %v", tt.query, err, ErrInvalidFilter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFilter(%q) failed: %v", tt.query, err)
+			}
+			if got := f.String(); got != tt.want {
+				t.Errorf("ParseFilter(%q) = %q, expected %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterSQL(t *testing.T) {
+	tests := []struct {
+		query     string
+		condition string
+		args      []interface{}
+	}{
+		{
+			query:     "100%_done",
+			condition: `lower(coalesce(text, '')) like ? escape '\'`,
+			args:      []interface{}{`%100\%\_done%`},
+		},
+		{
+			query:     "type:note -source:kindle",
+			condition: "type=? and not (coalesce(source, '')=?)",
+			args:      []interface{}{"note", "kindle"},
+		},
+		{
+			// books stored before normalization might have ISBN-10
+			query:     "isbn:0-306-40615-2",
+			condition: "book_id in (select Id from book where isbn=? or isbn=?)",
+			args:      []interface{}{"9780306406157", "0306406152"},
+		},
+		{
+			// 979 ISBNs have no ISBN-10
+			query:     "isbn:979-10-90636-07-1",
+			condition: "book_id in (select Id from book where isbn=?)",
+			args:      []interface{}{"9791090636071"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			f, err := ParseFilter(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			condition, args := f.sql()
+			if condition != tt.condition || !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("sql of %q = %q %v, expected %q %v", tt.query, condition, args, tt.condition, tt.args)
+			}
+		})
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	texts := []string{
+		"Layers and boundaries #architecture",
+		"#Architecture, see chapter 3",
+		"(#architecture)",
+		"Decisions #architecture-decisions",
+		"Software architecture without a tag",
+		"C#architecture",
+	}
+	forEachTestDatabase(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		annotations := testAnnotations(len(texts), 1)
+		for i := range annotations {
+			annotations[i].Text = texts[i]
+		}
+		writeAnnotations(t, db, startTestRun(t, db, "test"), 0, annotations)
+		reader, err := NewDBAnnotationReader(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter, err := ParseFilter("tag:architecture")
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := reader.ListAnnotations(ctx, AnnotationQuery{Filter: filter, OrderBy: OrderById})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []string
+		for _, a := range page.Annotations {
+			found = append(found, a.Text)
+		}
+		if !reflect.DeepEqual(found, texts[:3]) {
+			t.Errorf("expected the annotations tagged #architecture, got %q", found)
+		}
+	})
+}
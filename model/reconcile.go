@@ -0,0 +1,95 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var ErrIncompleteSnapshot = errors.New("import run did not see the complete snapshot of its source")
+
+// every annotation of a snapshot is written by the import run, so the ones it did not write, but which were last written
+// by an earlier snapshot of the same account, are gone; annotations of the source which came from other accounts are
+// not in the snapshot at all
+const missingAnnotationsCondition = `source=? and deleted_at is null and coalesce(updated_by_run, 0) != ?
+	and updated_by_run in (select Id from import_run where source=? and account=?)`
+
+// Reconciler finds annotations deleted at their source. It can be used only after an import run of a source
+// which exports a complete snapshot (like the O'Reilly CSV export), not of an append-only one (like Kindle clippings)
+type Reconciler interface {
+	// MissingAnnotations lists annotations of earlier snapshots of the run's account which are not in the snapshot the run ingested
+	MissingAnnotations(ctx context.Context, run *ImportRun) ([]Annotation, error)
+	// SoftDeleteMissing marks the missing annotations as deleted by the run, so that reverting the run restores them
+	SoftDeleteMissing(ctx context.Context, run *ImportRun) (deleted int, err error)
+}
+
+type reconciler struct {
+	db *sql.DB
+}
+
+func NewDBReconciler(db *sql.DB) Reconciler {
+	return &reconciler{
+		db: db,
+	}
+}
+
+// checkComplete refuses runs which might have missed some annotations of the snapshot, since reconciling them
+// would delete annotations which are still there
+func checkComplete(run *ImportRun) error {
+	switch {
+	case run.Resumed:
+		return fmt.Errorf("%w: import run %v resumed an interrupted one", ErrIncompleteSnapshot, run.Id)
+	case run.Failed > 0:
+		return fmt.Errorf("%w: import run %v failed to write %d annotations", ErrIncompleteSnapshot, run.Id, run.Failed)
+	}
+	return nil
+}
+
+func (r *reconciler) MissingAnnotations(ctx context.Context, run *ImportRun) (annotations []Annotation, err error) {
+	if err := checkComplete(run); err != nil {
+		return nil, err
+	}
+	rows, err := bind(r.db, dialectOf(r.db)).QueryContext(ctx,
+		"select "+annotationColumns+" from annotation where "+missingAnnotationsCondition+" order by book_id, Id", run.Source, run.Id, run.Source, run.Account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find annotations missing from import run %v: %w", run.Id, err)
+	}
+	defer utils.SafeClose(rows, &err)
+	for rows.Next() {
+		a, err := scanAnnotationRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, *a)
+	}
+	return annotations, rows.Err()
+}
+
+func (r *reconciler) SoftDeleteMissing(ctx context.Context, run *ImportRun) (deleted int, err error) {
+	if err := checkComplete(run); err != nil {
+		return 0, err
+	}
+	err = inTransaction(ctx, r.db, func(tx querier) error {
+		if _, err := tx.ExecContext(ctx, `
+	insert into annotation_before_run(run_id, annotation_id, `+annotationBeforeRunColumns+`)
+	select cast(? as bigint), Id, `+annotationBeforeRunColumns+` from annotation where `+missingAnnotationsCondition+`
+	on conflict(run_id, annotation_id) do nothing`, run.Id, run.Source, run.Id, run.Source, run.Account); err != nil {
+			return fmt.Errorf("failed to remember annotations missing from import run %v: %w", run.Id, err)
+		}
+		deleted, err = execCount(ctx, tx,
+			"update annotation set deleted_at=?, updated_by_run=?, change_cause=? where "+missingAnnotationsCondition,
+			time.Now().UTC(), run.Id, fmt.Sprintf("reconcile of import run #%d", run.Id), run.Source, run.Id, run.Source, run.Account)
+		if err != nil {
+			return fmt.Errorf("failed to soft-delete annotations missing from import run %v: %w", run.Id, err)
+		}
+		return nil
+	})
+	if err == nil {
+		log.Debugf("Soft-deleted %d annotations missing from import run %v", deleted, run.Id)
+	}
+	return deleted, err
+}
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestSoftDeleteMissing(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		annotations := testAnnotations(3, 1)
+		writeTestRun(t, db, "snapshot", "", annotations)
+		snapshot := writeTestRun(t, db, "snapshot", "", annotations[:2])
+
+		reconciler := NewDBReconciler(db)
+		missing, err := reconciler.MissingAnnotations(ctx, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(missing) != 1 || missing[0].Text != annotations[2].Text {
+			t.Fatalf("expected the third annotation to be missing, got %+v", missing)
+		}
+		deleted, err := reconciler.SoftDeleteMissing(ctx, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != 1 || len(readTestAnnotations(t, db, "deleted_at is not null")) != 1 {
+			t.Fatalf("expected the missing annotation to be soft-deleted, %d were", deleted)
+		}
+
+		if _, err := NewDBImportReverter(db).RevertImportRun(ctx, snapshot.Id); err != nil {
+			t.Fatal(err)
+		}
+		if deletedAfterRevert := readTestAnnotations(t, db, "deleted_at is not null"); len(deletedAfterRevert) != 0 {
+			t.Errorf("expected revert to restore the soft-deleted annotation, got %+v", deletedAfterRevert)
+		}
+	})
+}
+
+func TestSoftDeleteMissingOfOtherAccount(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		annotations := testAnnotations(4, 1)
+		// exports of two accounts, with different annotations
+		writeTestRun(t, db, "export.csv", "first", annotations[:2])
+		writeTestRun(t, db, "export.csv", "second", annotations[2:])
+		snapshot := writeTestRun(t, db, "export.csv", "first", annotations[:1])
+
+		deleted, err := NewDBReconciler(db).SoftDeleteMissing(ctx, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		softDeleted := readTestAnnotations(t, db, "deleted_at is not null")
+		if deleted != 1 || len(softDeleted) != 1 || softDeleted[0].Text != annotations[1].Text {
+			t.Errorf("expected only the annotation missing from the export of the first account to be soft-deleted, got %+v", softDeleted)
+		}
+	})
+}
+
+func TestSoftDeleteMissingOfRenamedExport(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, db *sql.DB) {
+		ctx := context.Background()
+		annotations := testAnnotations(3, 1)
+		// each export of the account is saved under a new file name
+		writeTestRun(t, db, "export-2022-01.csv", "account", annotations)
+		writeTestRun(t, db, "export-2022-02.csv", "account", annotations[:2])
+		snapshot := writeTestRun(t, db, "export-2022-03.csv", "account", annotations[:1])
+
+		deleted, err := NewDBReconciler(db).SoftDeleteMissing(ctx, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		softDeleted := readTestAnnotations(t, db, "deleted_at is not null")
+		if deleted != 2 || len(softDeleted) != 2 || softDeleted[0].Text != annotations[1].Text || softDeleted[1].Text != annotations[2].Text {
+			t.Errorf("expected the annotations missing from the latest export to be soft-deleted, got %+v", softDeleted)
+		}
+	})
+}
@@ -25,6 +25,18 @@ type Annotation struct {
 	Ts       time.Time
 	Origin   string
 	Type     AnnotationType
+	Chapter  Chapter
+	// Source is the kind of extractor which produced the annotation (kindle, oreilly...)
+	Source string
+	// ExternalId identifies the annotation uniquely within its Source, if the source provides such identifier
+	ExternalId string
+	// Fingerprint of the normalized text, used to recognize the same annotation with slightly different text
+	Fingerprint string
+	// CreatedByRun and UpdatedByRun are Ids of the import runs which created and last wrote the annotation (0 if none)
+	CreatedByRun int64
+	UpdatedByRun int64
+	// DeletedAt is zero unless the annotation was soft-deleted, since its source no longer has it
+	DeletedAt time.Time
 }
 
 type Location struct {
@@ -47,115 +59,143 @@ type annotationRepository struct {
 	db *sql.DB
 }
 
-func NewDBAnnotationRepository(db *sql.DB) AnnotationRepository {
-	//TODO: can location have type json?
-	sqlStmt := `
-	create table if not exists annotation (
-		Id integer not null primary key,
-		book_id integer, 
-		text text,
-		location text,
-		ts timestamp,
-		origin text,
-		type text,
-    FOREIGN KEY (book_id)
-       REFERENCES book (id) 
-	);
-    create index if not exists annotation_text on annotation(book_id, text);
-	`
-	_, err := db.Exec(sqlStmt)
-	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlStmt)
+func NewDBAnnotationRepository(db *sql.DB) (AnnotationRepository, error) {
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, err
 	}
 	return &annotationRepository{
 		db: db,
-	}
+	}, nil
 }
 
 func (r *annotationRepository) UpsertAnnotation(ctx context.Context, a *Annotation) (existed bool, err error) {
-	tx, err := r.db.Begin()
-	utils.MustCheck(err)
-	existingA, ok, err := r.findByBookIdAndText(a.BookId, a.Text)
+	err = inTransaction(ctx, r.db, func(tx querier) error {
+		existed, err = upsertAnnotation(ctx, tx, a, nil)
+		return err
+	})
+	return existed, err
+}
+
+// upsertAnnotation finds and writes the annotation using the same transaction
+func upsertAnnotation(ctx context.Context, q querier, a *Annotation, policies *MergePolicies) (existed bool, err error) {
+	a.Fingerprint = Fingerprint(a.Text)
+	existingA, ok, err := findAnnotation(ctx, q, a)
 	if err != nil {
 		return false, fmt.Errorf("failed to upsert annotation: %w", err)
 	}
 	if ok {
-		a.Id = existingA.Id
-		if !existingA.Location.IsEmpty() && !a.Location.IsEmpty() {
-			a.Location = existingA.Location
-		}
-		if existingA.Text != "" && a.Text == "" {
-			a.Text = existingA.Text
-		}
-		if existingA.Ts.Unix() != 0 && a.Ts.Unix() == 0 {
-			a.Ts = existingA.Ts
-		}
-		if existingA.Origin != "" && a.Origin == "" {
-			a.Origin = existingA.Origin
-		}
-		if existingA.Type != "" && a.Type == "" {
-			a.Type = existingA.Type
+		if a.UpdatedByRun != 0 {
+			if err := rememberAnnotation(ctx, q, a.UpdatedByRun, existingA.Id); err != nil {
+				return false, err
+			}
 		}
-		stmt, err := tx.Prepare("update annotation set location=?, text=?, ts=?, origin=?, type=? where Id=?")
-		utils.MustCheck(err)
-		defer utils.SafeClose(stmt, &err)
+		mergeAnnotation(existingA, a, policies)
 		locationAsString, err := json.Marshal(a.Location)
 		if err != nil {
-			log.Fatalf("unexpected problem: could not serialize into JSON %+v: %v", a.Location, err)
+			return false, fmt.Errorf("could not serialize into JSON %+v: %w", a.Location, err)
 		}
-		utils.MustCheck(err)
-		_, err = stmt.Exec(locationAsString, a.Text, a.Ts, a.Origin, a.Type, a.Id)
+		_, err = q.ExecContext(ctx, "update annotation set location=?, text=?, ts=?, origin=?, type=?, chapter_title=?, chapter_url=?, chapter_ordinal=?, source=?, external_id=?, fingerprint=?, updated_by_run=?, change_cause=?, deleted_at=null where Id=?",
+			string(locationAsString), a.Text, a.Ts, a.Origin, a.Type, a.Chapter.Title, a.Chapter.Url, a.Chapter.Ordinal, a.Source, nullIfEmpty(a.ExternalId), a.Fingerprint,
+			nullIfZero(a.UpdatedByRun), upsertCause(a.UpdatedByRun), a.Id)
 		if err != nil {
 			return false, fmt.Errorf("failed to update existing annotation: %w", err)
 		}
 		log.Debugf("Updated existing annotation with Id %v", a.Id)
-		existed = true
-	} else {
-		stmt, err := tx.Prepare("insert into annotation(book_id, location, text, ts, origin, type) values(?,?,?,?,?,?)")
-		utils.MustCheck(err)
-		defer utils.SafeClose(stmt, &err)
-		locationAsString, err := json.Marshal(a.Location)
-		if err != nil {
-			log.Fatalf("unexpected problem: could not serialize into JSON %+v: %v", a.Location, err)
-		}
-		utils.MustCheck(err)
-		insertResult, err := stmt.Exec(a.BookId, locationAsString, a.Text, a.Ts, a.Origin, a.Type)
-		if err != nil {
-			return false, fmt.Errorf("failed to insert new annotation: %w", err)
-		}
-		annotationId, err := insertResult.LastInsertId()
-		if err != nil {
-			return false, fmt.Errorf("failed to retrieve last inserted annotation: %w", err)
+		return true, nil
+	}
+	locationAsString, err := json.Marshal(a.Location)
+	if err != nil {
+		return false, fmt.Errorf("could not serialize into JSON %+v: %w", a.Location, err)
+	}
+	a.CreatedByRun = a.UpdatedByRun
+	err = q.QueryRowContext(ctx, annotationInsert+" returning Id", annotationInsertArgs(a, locationAsString)...).Scan(&a.Id)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert new annotation: %w", err)
+	}
+	log.Debugf("Inserted new annotation with Id %v", a.Id)
+	return false, nil
+}
+
+// findAnnotation prefers the identifier given by the source, so that an edited annotation is still recognized,
+// and then the text fingerprint at the same location, so that the same text with different whitespace or quotes
+// is recognized, but not the same short note made elsewhere in the book. Annotations which already have an external
+// identifier are never matched by fingerprint, otherwise another annotation of the source with the same text
+// would take over their identifier
+func findAnnotation(ctx context.Context, q querier, template *Annotation) (a *Annotation, ok bool, err error) {
+	if template.ExternalId != "" {
+		a, ok, err = queryAnnotation(ctx, q, "source=? and external_id=?", template.Source, template.ExternalId)
+		if err != nil || ok {
+			return
 		}
-		a.Id = annotationId
-		log.Debugf("Inserted new annotation with Id %v", a.Id)
-		existed = false
 	}
-	utils.MustCheck(tx.Commit())
-	return
+	locationAsString, err := json.Marshal(template.Location)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not serialize into JSON %+v: %w", template.Location, err)
+	}
+	return queryAnnotation(ctx, q, "book_id=? and type=? and location=? and fingerprint=? and external_id is null", template.BookId, template.Type,
+		string(locationAsString), template.Fingerprint)
 }
 
-func (r *annotationRepository) findByBookIdAndText(bookId int64, text string) (a *Annotation, ok bool, err error) {
-	rows, err := r.db.Query("select Id, book_id, location, text, ts, origin, type from annotation where book_id=? and text=?", bookId, text)
+func queryAnnotation(ctx context.Context, q querier, condition string, args ...interface{}) (a *Annotation, ok bool, err error) {
+	rows, err := q.QueryContext(ctx, "select "+annotationColumns+" from annotation where "+condition, args...)
 	if err != nil {
-		return nil, false, fmt.Errorf("failed to run the query findByBookIdAndText: %w", err)
+		return nil, false, fmt.Errorf("failed to query annotation by %v: %w", condition, err)
 	}
 	defer utils.SafeClose(rows, &err)
-	a = &Annotation{}
-	var locationAsString string
+	return scanAnnotation(rows)
+}
+
+const annotationColumns = "Id, book_id, location, text, ts, origin, type, chapter_title, chapter_url, chapter_ordinal, source, external_id, fingerprint, created_by_run, updated_by_run, deleted_at"
+
+func scanAnnotation(rows *sql.Rows) (a *Annotation, ok bool, err error) {
 	if rows.Next() {
-		err := rows.Scan(&a.Id, &a.BookId, &locationAsString, &a.Text, &a.Ts, &a.Origin, &a.Type)
+		a, err = scanAnnotationRow(rows)
 		if err != nil {
-			return nil, false, fmt.Errorf("failed to scan successfully retrieved result set for annotation: %w", err)
+			return nil, false, err
 		}
-		if locationAsString != "" {
-			err = json.Unmarshal([]byte(locationAsString), &a.Location)
-			if err != nil {
-				log.Fatalf("unexpected problem: could not deserialize into JSON %+v: %v", a.Location, err)
-			}
-		}
-		utils.MustCheck(err)
 		return a, true, nil
 	}
 	return nil, false, nil
 }
+
+// scanAnnotationRow scans annotationColumns, followed by the extra columns of the query, if any
+func scanAnnotationRow(rows *sql.Rows, extra ...interface{}) (a *Annotation, err error) {
+	a = &Annotation{}
+	var locationAsString string
+	var chapterTitle, chapterUrl, source, externalId, fingerprint sql.NullString
+	var chapterOrdinal, createdByRun, updatedByRun sql.NullInt64
+	var deletedAt sql.NullTime
+	destinations := []interface{}{&a.Id, &a.BookId, &locationAsString, &a.Text, &a.Ts, &a.Origin, &a.Type, &chapterTitle, &chapterUrl, &chapterOrdinal, &source, &externalId, &fingerprint,
+		&createdByRun, &updatedByRun, &deletedAt}
+	err = rows.Scan(append(destinations, extra...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan successfully retrieved result set for annotation: %w", err)
+	}
+	a.Chapter.Title = chapterTitle.String
+	a.Chapter.Url = chapterUrl.String
+	if chapterOrdinal.Valid {
+		ordinal := int(chapterOrdinal.Int64)
+		a.Chapter.Ordinal = &ordinal
+	}
+	a.Source = source.String
+	a.ExternalId = externalId.String
+	a.Fingerprint = fingerprint.String
+	a.CreatedByRun = createdByRun.Int64
+	a.UpdatedByRun = updatedByRun.Int64
+	a.DeletedAt = deletedAt.Time
+	if locationAsString != "" {
+		err = json.Unmarshal([]byte(locationAsString), &a.Location)
+		if err != nil {
+			return nil, fmt.Errorf("could not deserialize location of annotation %v from JSON %v: %w", a.Id, locationAsString, err)
+		}
+	}
+	return a, nil
+}
+
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullIfZero(i int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: i, Valid: i != 0}
+}
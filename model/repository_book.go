@@ -3,8 +3,9 @@ package model
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	"github.com/milanaleksic/tt-extractor-kindle/isbn"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -13,82 +14,123 @@ type Book struct {
 	Name    string
 	Authors string
 	Isbn    string
+	// Source is the kind of extractor which produced the book; it is not stored, only its merge policies are used
+	Source string
 }
 
 type BookRepository interface {
 	UpsertBook(ctx context.Context, book *Book) (existed bool, err error)
 }
+
+var ErrBookNotFound = errors.New("book not found")
+
+// BookReader reads books, for consumers which should not write raw SQL against the schema
+type BookReader interface {
+	GetBook(ctx context.Context, id int64) (*Book, error)
+	// ListBooks returns all books, the oldest first
+	ListBooks(ctx context.Context) ([]Book, error)
+}
+
 type bookRepository struct {
-	db         *sql.DB
+	db *sql.DB
 }
 
-func NewDBBookRepository(db *sql.DB) BookRepository {
-	sqlStmt := `
-	create table if not exists book (
-		Id integer not null primary key, 
-		isbn text,
-		name text,
-		authors text
-	);
-    create index if not exists book_name on book(name);
-	create index if not exists book_isbn_name on book(isbn);
-	`
-	_, err := db.Exec(sqlStmt)
-	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlStmt)
+func NewDBBookRepository(db *sql.DB) (BookRepository, error) {
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, err
 	}
 	return &bookRepository{
-		db:         db,
+		db: db,
+	}, nil
+}
+
+func NewDBBookReader(db *sql.DB) (BookReader, error) {
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, err
+	}
+	return &bookRepository{
+		db: db,
+	}, nil
+}
+
+func (r *bookRepository) GetBook(ctx context.Context, id int64) (*Book, error) {
+	book := &Book{}
+	err := bind(r.db, dialectOf(r.db)).QueryRowContext(ctx, "select book.id, book.name, book.isbn, book.authors from book where Id=?", id).
+		Scan(&book.Id, &book.Name, &book.Isbn, &book.Authors)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %v", ErrBookNotFound, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get book %v: %w", id, err)
 	}
+	return book, nil
+}
+
+func (r *bookRepository) ListBooks(ctx context.Context) ([]Book, error) {
+	return listBooks(ctx, bind(r.db, dialectOf(r.db)))
 }
 
 func (r *bookRepository) UpsertBook(ctx context.Context, book *Book) (existed bool, err error) {
-	tx, err := r.db.Begin()
-	utils.MustCheck(err)
-	existingBook, err := r.find(book)
+	err = inTransaction(ctx, r.db, func(tx querier) error {
+		existed, err = upsertBook(ctx, tx, book, 0, nil)
+		return err
+	})
+	return existed, err
+}
+
+// upsertBook finds and writes the book using the same transaction, so that it sees books not yet committed;
+// run is the Id of the import run doing the write (0 if none)
+func upsertBook(ctx context.Context, q querier, book *Book, run int64, policies *MergePolicies) (existed bool, err error) {
+	if err := normalizeIsbn(book); err != nil {
+		return false, err
+	}
+	existingBook, err := findBook(ctx, q, book)
 	if err != nil {
 		return false, fmt.Errorf("failed to upsert book: %w", err)
 	}
 	if existingBook != nil {
-		book.Id = existingBook.Id
-		if existingBook.Isbn != "" && book.Isbn == "" {
-			book.Isbn = existingBook.Isbn
-		}
-		if existingBook.Name != "" && book.Name == "" {
-			book.Name = existingBook.Name
+		mergeBook(existingBook, book, policies)
+		if run != 0 {
+			if err := rememberBook(ctx, q, run, book.Id); err != nil {
+				return false, err
+			}
 		}
-		if existingBook.Authors != "" && book.Authors == "" {
-			book.Authors = existingBook.Authors
-		}
-		stmt, err := tx.Prepare("update book set isbn=?, name=?, authors=? where Id=?")
-		utils.MustCheck(err)
-		defer utils.SafeClose(stmt, &err)
-		_, err = stmt.Exec(book.Isbn, book.Name, book.Authors, book.Id)
+		_, err = q.ExecContext(ctx, "update book set isbn=?, name=?, normalized_name=?, authors=?, updated_by_run=coalesce(?, updated_by_run) where Id=?",
+			book.Isbn, book.Name, NormalizeTitle(book.Name), book.Authors, nullIfZero(run), book.Id)
 		if err != nil {
 			return false, fmt.Errorf("failed to update existing book: %w", err)
 		}
 		log.Debugf("Updated existing book with Id %v", book.Id)
-		existed = true
-	} else {
-		stmt, err := tx.Prepare("insert into book(isbn, name, authors) values(?,?,?)")
-		utils.MustCheck(err)
-		defer utils.SafeClose(stmt, &err)
-		insertResult, err := stmt.Exec(book.Isbn, book.Name, book.Authors)
-		if err != nil {
-			return false, fmt.Errorf("failed to retrieve last inserted book: %w", err)
-		}
-		bookId, err := insertResult.LastInsertId()
-		book.Id = bookId
-		existed = false
+		return true, nil
+	}
+	err = q.QueryRowContext(ctx, "insert into book(isbn, name, normalized_name, authors, created_by_run, updated_by_run) values(?,?,?,?,?,?) returning Id",
+		book.Isbn, book.Name, NormalizeTitle(book.Name), book.Authors, nullIfZero(run), nullIfZero(run)).Scan(&book.Id)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert new book: %w", err)
 	}
-	utils.MustCheck(tx.Commit())
-	return
+	return false, nil
 }
 
-func (r *bookRepository) find(bookTemplate *Book) (book *Book, err error) {
+func normalizeIsbn(book *Book) error {
+	if book.Isbn == "" {
+		return nil
+	}
+	normalized, err := isbn.Normalize(book.Isbn)
+	if err != nil {
+		return fmt.Errorf("refusing to upsert book %v: %w", book.Name, err)
+	}
+	book.Isbn = normalized
+	return nil
+}
+
+func findBook(ctx context.Context, q querier, bookTemplate *Book) (book *Book, err error) {
 	book = &Book{}
 	if bookTemplate.Isbn != "" {
-		row := r.db.QueryRow("select book.id, book.name, book.isbn, book.authors from book where isbn=?", bookTemplate.Isbn)
+		// books stored before ISBN normalization might still have ISBN-10, which only 978 ISBNs have
+		query, args := "select book.id, book.name, book.isbn, book.authors from book where isbn=?", []interface{}{bookTemplate.Isbn}
+		if isbn10, ok := isbn.To10(bookTemplate.Isbn); ok {
+			query, args = query+" or isbn=?", append(args, isbn10)
+		}
+		row := q.QueryRowContext(ctx, query, args...)
 		err = row.Scan(&book.Id, &book.Name, &book.Isbn, &book.Authors)
 		if err == nil {
 			return book, nil
@@ -98,12 +140,35 @@ func (r *bookRepository) find(bookTemplate *Book) (book *Book, err error) {
 		}
 	}
 
-	row := r.db.QueryRow("select book.id, book.name, book.isbn, book.authors from book where name=?", bookTemplate.Name)
-	err = row.Scan(&book.Id, &book.Name, &book.Isbn, &book.Authors)
-	if err == sql.ErrNoRows {
+	books, err := queryBooks(ctx, q, "where name=? order by book.id", bookTemplate.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range books {
+		// another edition of the book has the same name, but a different ISBN
+		if !differentIsbns(candidate, *bookTemplate) {
+			return &candidate, nil
+		}
+	}
+	return findSimilarBook(ctx, q, bookTemplate)
+}
+
+// findSimilarBook falls back to fuzzy matching, since different sources name the same book slightly differently;
+// only books with the same normalized name can be similar, and SameBook never matches books with different ISBNs
+func findSimilarBook(ctx context.Context, q querier, bookTemplate *Book) (book *Book, err error) {
+	normalized := NormalizeTitle(bookTemplate.Name)
+	if normalized == "" {
 		return nil, nil
-	} else if err != nil {
-		return nil, fmt.Errorf("failed to scan successfully retrieved result set for book: %w", err)
 	}
-	return book, nil
+	books, err := queryBooks(ctx, q, "where normalized_name=? order by book.id", normalized)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range books {
+		if SameBook(candidate, *bookTemplate) {
+			log.Debugf("Book %v matched existing book %v", bookTemplate, candidate)
+			return &candidate, nil
+		}
+	}
+	return nil, nil
 }
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestUpsertBookKeepsEditionsApart(t *testing.T) {
+	forEachTestDatabase(t, func(t *testing.T, db *sql.DB) {
+		books, err := NewDBBookRepository(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEditions(t, books)
+	})
+	t.Run("memory", func(t *testing.T) {
+		testEditions(t, NewMemoryStore().BookRepository())
+	})
+}
+
+// testEditions upserts two editions of a book with the same title, which are told apart only by their ISBNs
+func testEditions(t *testing.T, books BookRepository) {
+	ctx := context.Background()
+	upsert := func(book Book) (int64, bool) {
+		t.Helper()
+		existed, err := books.UpsertBook(ctx, &book)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return book.Id, existed
+	}
+	title := "Designing Data-Intensive Applications"
+	first, _ := upsert(Book{Name: title, Authors: "Martin Kleppmann", Isbn: "9781449373320"})
+	second, existed := upsert(Book{Name: title, Authors: "Martin Kleppmann", Isbn: "9780306406157"})
+	if existed || second == first {
+		t.Errorf("expected the second edition to be a new book, got book %d of the first edition", second)
+	}
+	third, existed := upsert(Book{Name: title + ": Third Edition", Authors: "Kleppmann, Martin", Isbn: "9780132350884"})
+	if existed || third == first || third == second {
+		t.Errorf("expected the similar title with another ISBN to be a new book, got book %d", third)
+	}
+	again, existed := upsert(Book{Name: title, Authors: "Martin Kleppmann", Isbn: "978-0-306-40615-7"})
+	if !existed || again != second {
+		t.Errorf("expected the second edition to be found by its ISBN, got book %d", again)
+	}
+	withoutIsbn, existed := upsert(Book{Name: title, Authors: "Martin Kleppmann"})
+	if !existed || withoutIsbn != first {
+		t.Errorf("expected the book without ISBN to match the first book with its title, got book %d", withoutIsbn)
+	}
+}
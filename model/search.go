@@ -0,0 +1,134 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+	"strings"
+)
+
+var ErrSearchUnsupported = errors.New("full-text search is available only with SQLite databases")
+
+// annotationFts indexes text of annotations together with the title and authors of their book (rowid is the
+// annotation Id); triggers keep it in sync with both tables
+const annotationFts = `
+	create virtual table if not exists annotation_fts using fts5(text, book_name, book_authors, tokenize='unicode61 remove_diacritics 2');
+	insert into annotation_fts(rowid, text, book_name, book_authors)
+	select annotation.Id, annotation.text, book.name, book.authors from annotation left join book on book.Id = annotation.book_id;
+	create trigger if not exists annotation_fts_insert after insert on annotation
+	begin
+		insert into annotation_fts(rowid, text, book_name, book_authors)
+		values (new.Id, new.text, (select name from book where Id = new.book_id), (select authors from book where Id = new.book_id));
+	end;
+	create trigger if not exists annotation_fts_update after update of text, book_id on annotation
+	begin
+		delete from annotation_fts where rowid = old.Id;
+		insert into annotation_fts(rowid, text, book_name, book_authors)
+		values (new.Id, new.text, (select name from book where Id = new.book_id), (select authors from book where Id = new.book_id));
+	end;
+	create trigger if not exists annotation_fts_delete after delete on annotation
+	begin
+		delete from annotation_fts where rowid = old.Id;
+	end;
+	create trigger if not exists annotation_fts_book_update after update of name, authors on book
+	begin
+		update annotation_fts set book_name = new.name, book_authors = new.authors
+		where rowid in (select Id from annotation where book_id = new.Id);
+	end;
+`
+
+// SearchQuery finds annotations by their text and the title and authors of their book
+type SearchQuery struct {
+	// Text is an FTS5 query: words, "phrases", prefixes like comput*, AND, OR and NOT
+	Text   string
+	BookId int64
+	Type   AnnotationType
+	// Limit is the number of the best results returned, 0 for all of them
+	Limit int
+	// MarkStart and MarkEnd surround the matched terms in the snippet ([ and ] if empty)
+	MarkStart string
+	MarkEnd   string
+}
+
+type SearchResult struct {
+	Annotation Annotation
+	Book       Book
+	// Snippet is the part of the text around the matched terms
+	Snippet string
+	// Rank is the relevance of the result, lower is better
+	Rank float64
+}
+
+type AnnotationSearcher interface {
+	// Search returns the annotations matching the query, the most relevant first; soft-deleted annotations are left out
+	Search(ctx context.Context, query SearchQuery) ([]SearchResult, error)
+}
+
+type annotationSearcher struct {
+	db *sql.DB
+}
+
+func NewDBAnnotationSearcher(db *sql.DB) (AnnotationSearcher, error) {
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, err
+	}
+	return &annotationSearcher{
+		db: db,
+	}, nil
+}
+
+func (s *annotationSearcher) Search(ctx context.Context, query SearchQuery) (results []SearchResult, err error) {
+	if dialectOf(s.db) == postgresDialect {
+		return nil, ErrSearchUnsupported
+	}
+	markStart, markEnd := query.MarkStart, query.MarkEnd
+	if markStart == "" && markEnd == "" {
+		markStart, markEnd = "[", "]"
+	}
+	var columns []string
+	for _, c := range strings.Split(annotationColumns, ", ") {
+		columns = append(columns, "annotation."+c)
+	}
+	// matches in the text weigh more than the ones in the title or authors of the book
+	sqlQuery := "select " + strings.Join(columns, ", ") + `, coalesce(book.name, ''), coalesce(book.isbn, ''), coalesce(book.authors, ''),
+		snippet(annotation_fts, 0, ?, ?, '…', 24), bm25(annotation_fts, 1.0, 0.5, 0.5) as rank
+	from annotation_fts
+	join annotation on annotation.Id = annotation_fts.rowid
+	left join book on book.Id = annotation.book_id
+	where annotation_fts match ? and annotation.deleted_at is null`
+	args := []interface{}{markStart, markEnd, query.Text}
+	if query.BookId != 0 {
+		sqlQuery += " and annotation.book_id=?"
+		args = append(args, query.BookId)
+	}
+	if query.Type != "" {
+		sqlQuery += " and annotation.type=?"
+		args = append(args, query.Type)
+	}
+	sqlQuery += " order by rank"
+	if query.Limit > 0 {
+		sqlQuery += " limit ?"
+		args = append(args, query.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for %q: %w", query.Text, err)
+	}
+	defer utils.SafeClose(rows, &err)
+	for rows.Next() {
+		var r SearchResult
+		a, err := scanAnnotationRow(rows, &r.Book.Name, &r.Book.Isbn, &r.Book.Authors, &r.Snippet, &r.Rank)
+		if err != nil {
+			return nil, err
+		}
+		r.Annotation = *a
+		r.Book.Id = a.BookId
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search for %q: %w", query.Text, err)
+	}
+	return results, nil
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
+)
+
+// Stats summarize what the database contains; soft-deleted annotations are counted only in Deleted
+type Stats struct {
+	Books       int
+	Annotations int
+	ByType      map[AnnotationType]int
+	// BySource counts annotations by the extractor which ingested them, "" for those ingested before sources were tracked
+	BySource   map[string]int
+	Deleted    int
+	ImportRuns int
+	// LastImport is the latest import run, nil if there was none
+	LastImport *ImportRun
+}
+
+type StatsReader interface {
+	Stats(ctx context.Context) (*Stats, error)
+}
+
+type statsReader struct {
+	db *sql.DB
+}
+
+func NewDBStatsReader(db *sql.DB) (StatsReader, error) {
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, err
+	}
+	return &statsReader{
+		db: db,
+	}, nil
+}
+
+func (r *statsReader) Stats(ctx context.Context) (*Stats, error) {
+	q := bind(r.db, dialectOf(r.db))
+	s := &Stats{ByType: make(map[AnnotationType]int), BySource: make(map[string]int)}
+	err := q.QueryRowContext(ctx, `
+	select (select count(*) from book),
+		(select count(*) from annotation where deleted_at is null),
+		(select count(*) from annotation where deleted_at is not null),
+		(select count(*) from import_run)`).Scan(&s.Books, &s.Annotations, &s.Deleted, &s.ImportRuns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count books and annotations: %w", err)
+	}
+	if err := countAnnotations(ctx, q, "type", func(key string, count int) { s.ByType[AnnotationType(key)] = count }); err != nil {
+		return nil, err
+	}
+	if err := countAnnotations(ctx, q, "coalesce(source, '')", func(key string, count int) { s.BySource[key] = count }); err != nil {
+		return nil, err
+	}
+
+	var run ImportRun
+	var finishedAt, revertedAt sql.NullTime
+	err = q.QueryRowContext(ctx, `
+	select Id, source, origin, started_at, finished_at, coalesce(inserted, 0), coalesce(updated, 0), coalesce(failed, 0), reverted_at
+	from import_run order by Id desc limit 1`).Scan(&run.Id, &run.Source, &run.Origin, &run.StartedAt, &finishedAt,
+		&run.Inserted, &run.Updated, &run.Failed, &revertedAt)
+	if err == nil {
+		run.FinishedAt = finishedAt.Time
+		run.RevertedAt = revertedAt.Time
+		s.LastImport = &run
+	} else if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to read the last import run: %w", err)
+	}
+	return s, nil
+}
+
+// countAnnotations counts annotations which are not deleted, grouped by the expression
+func countAnnotations(ctx context.Context, q querier, expression string, count func(key string, count int)) (err error) {
+	rows, err := q.QueryContext(ctx, "select "+expression+", count(*) from annotation where deleted_at is null group by "+expression)
+	if err != nil {
+		return fmt.Errorf("failed to count annotations: %w", err)
+	}
+	defer utils.SafeClose(rows, &err)
+	for rows.Next() {
+		var key string
+		var n int
+		if err := rows.Scan(&key, &n); err != nil {
+			return fmt.Errorf("failed to count annotations: %w", err)
+		}
+		count(key, n)
+	}
+	return rows.Err()
+}
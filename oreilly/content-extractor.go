@@ -1,50 +1,25 @@
 package oreilly
 
 import (
+	"bytes"
 	"context"
 	"encoding/csv"
 	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/isbn"
 	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"github.com/milanaleksic/tt-extractor-kindle/utils"
 	log "github.com/sirupsen/logrus"
 	"io"
-	"reflect"
 	"regexp"
+	"strings"
 	"time"
 )
 
-type format byte
-
-const (
-	formatUnknown format = iota
-	formatV1
-	formatV2
-)
+const Source = "oreilly"
 
 var (
-	isbnRegex = regexp.MustCompile(`(?:97[89])?\d{9}(?:\d|X)`)
-	formats   = map[format][]string{
-		formatV1: {
-			"Book Title",
-			"Authors",
-			"Chapter Title",
-			"Date of Highlight",
-			"Book URL",
-			"Chapter URL",
-			"Highlight URL",
-			"Highlight",
-			"Personal Note",
-		},
-		formatV2: {
-			"Book Title",
-			"Chapter Title",
-			"Date of Highlight",
-			"Book URL",
-			"Chapter URL",
-			"Annotation URL",
-			"Highlight",
-			"Personal Note",
-		},
-	}
+	isbnRegex           = regexp.MustCompile(`(?:97[89])?\d{9}(?:\d|X)`)
+	chapterOrdinalRegex = regexp.MustCompile(`/ch(\d+)\.x?html`)
 )
 
 type ContentExtractor struct {
@@ -52,20 +27,49 @@ type ContentExtractor struct {
 	annotationRepo      model.AnnotationRepository
 	annotationsUpdated  int
 	annotationsInserted int
+	progress            *model.Progress[[]string]
 }
 
 func NewContentExtractor(bookRepo model.BookRepository, annotationRepo model.AnnotationRepository) *ContentExtractor {
 	return &ContentExtractor{
 		bookRepo:       model.NewCachedBookRepository(bookRepo),
 		annotationRepo: annotationRepo,
+		progress:       model.NewProgress[[]string](nil),
+	}
+}
+
+func (e *ContentExtractor) Name() string {
+	return Source
+}
+
+// Detect recognizes an export (of any version) by its header, which has to have all the required columns
+func (e *ContentExtractor) Detect(head []byte) bool {
+	r := csv.NewReader(bytes.NewReader(head))
+	r.FieldsPerRecord = -1
+	record, err := r.Read()
+	if err != nil {
+		return false
 	}
+	h := make(header)
+	for i, name := range record {
+		h[columnName(name)] = i
+	}
+	return len(h.missing()) == 0
+}
+
+func (e *ContentExtractor) ResumeFrom(c *model.Checkpoint) {
+	e.progress = model.NewProgress[[]string](c)
+}
+
+func (e *ContentExtractor) Checkpoint() model.Checkpoint {
+	return e.progress.Checkpoint()
 }
 
 func (e *ContentExtractor) IngestRecords(ctx context.Context, reader io.Reader) (err error) {
 	begin := time.Now()
 	r := csv.NewReader(reader)
-	firstRecord := true
-	version := formatUnknown
+	r.FieldsPerRecord = -1
+	var h header
 	for {
 		record, err := r.Read()
 		if err == io.EOF {
@@ -74,118 +78,130 @@ func (e *ContentExtractor) IngestRecords(ctx context.Context, reader io.Reader)
 		if err != nil {
 			return err
 		}
-		if firstRecord {
-			if reflect.DeepEqual(record, formats[formatV1]) {
-				version = formatV1
-			} else if reflect.DeepEqual(record, formats[formatV2]) {
-				version = formatV2
-			} else {
-				return fmt.Errorf("CSV does not have expected format: %+v encountered, but expected one of: %+v", record, formats)
+		if h == nil {
+			h, err = parseHeader(record)
+			if err != nil {
+				return err
 			}
-			log.Infof("Proceeding with format version %v", version)
-			firstRecord = false
+			log.Infof("Proceeding with columns %v", h)
 		} else {
-			if version == formatV1 {
-				err = e.ingestRecordV1(ctx, record)
-			} else if version == formatV2 {
-				err = e.ingestRecordV2(ctx, record)
+			if err := ctx.Err(); err != nil {
+				return e.interrupted(err)
 			}
-			if err != nil {
-				return fmt.Errorf("error while ingesting row %+v: %w", record, err)
+			if err := e.ingestRecords(ctx, h, e.progress.Track(record, strings.Join(record, "\x1f"))); err != nil {
+				return err
 			}
 		}
 	}
+	if err := e.ingestRecords(ctx, h, e.progress.Flush()); err != nil {
+		return err
+	}
 	log.Infof("Ingestion completed from oreilly in %dms; updated %v annotations and created %v new ones",
 		time.Now().Sub(begin).Milliseconds(), e.annotationsUpdated, e.annotationsInserted)
 	return err
 }
 
-func (e *ContentExtractor) ingestRecordV1(ctx context.Context, record []string) (err error) {
-	book := &model.Book{
-		Name:    record[0],
-		Authors: record[1],
-		Isbn:    "",
-	}
-
-	submatch := isbnRegex.FindAllStringSubmatch(record[4], -1)
-	if len(submatch) == 0 {
-		return fmt.Errorf("could not match the ISBN in the book page URL: %v", record[4])
-	}
-	book.Isbn = submatch[0][0]
-
-	_, err = e.bookRepo.UpsertBook(ctx, book)
-	if err != nil {
-		log.Errorf("Failed to upsert a book: %v", err)
-		return
-	}
-
-	parsedTime, err := time.Parse("2006-01-02", record[3])
-	if err != nil {
-		return fmt.Errorf("could not parsedTime the day of highlight from %v: %w", record[3], err)
-	}
-	a := &model.Annotation{
-		BookId:   book.Id,
-		Text:     record[7],
-		Location: model.Location{},
-		Ts:       parsedTime,
-		Origin:   record[4],
-		Type:     model.Highlight,
-	}
-	existed, err := e.annotationRepo.UpsertAnnotation(ctx, a)
-	if err != nil {
-		log.Errorf("Failed to upsert an annotation: %v", err)
-		return
-	}
-	if existed {
-		e.annotationsUpdated++
-	} else {
-		e.annotationsInserted++
+func (e *ContentExtractor) ingestRecords(ctx context.Context, h header, records [][]string) error {
+	for _, record := range records {
+		err := e.ingestRecord(ctx, h, record)
+		// record might not have been stored if cancellation interrupted it
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return e.interrupted(ctxErr)
+		}
+		if err != nil {
+			return fmt.Errorf("error while ingesting row %+v: %w", record, err)
+		}
+		e.progress.Done()
 	}
+	return nil
+}
 
-	return
+func (e *ContentExtractor) interrupted(err error) error {
+	log.Warnf("Ingestion from oreilly interrupted after %d records; updated %v annotations and created %v new ones",
+		e.progress.Records(), e.annotationsUpdated, e.annotationsInserted)
+	return err
 }
 
-func (e *ContentExtractor) ingestRecordV2(ctx context.Context, record []string) (err error) {
+func (e *ContentExtractor) ingestRecord(ctx context.Context, h header, record []string) (err error) {
 	book := &model.Book{
-		Name:    record[0],
-		Authors: "",
+		Name:    h.get(record, columnBookTitle),
+		Authors: h.get(record, columnAuthors),
 		Isbn:    "",
+		Source:  Source,
 	}
 
-	submatch := isbnRegex.FindAllStringSubmatch(record[3], -1)
-	if len(submatch) == 0 {
-		return fmt.Errorf("could not match the ISBN in the book page URL: %v", record[3])
+	bookUrl := h.get(record, columnBookUrl)
+	// URL might contain other numbers too, so take the first one which passes the ISBN checksum
+	for _, candidate := range isbnRegex.FindAllString(bookUrl, -1) {
+		if isbn.IsValid(candidate) {
+			book.Isbn = candidate
+			break
+		}
+	}
+	if book.Isbn == "" {
+		return fmt.Errorf("could not match the ISBN in the book page URL: %v", bookUrl)
 	}
-	book.Isbn = submatch[0][0]
 
-	_, err = e.bookRepo.UpsertBook(ctx, book)
-	if err != nil {
-		log.Errorf("Failed to upsert a book: %v", err)
-		return
+	if _, err = e.bookRepo.UpsertBook(ctx, book); err != nil {
+		return fmt.Errorf("failed to upsert a book: %w", err)
 	}
 
-	parsedTime, err := time.Parse("2006-01-02", record[2])
+	date := h.get(record, columnDate)
+	parsedTime, err := time.Parse("2006-01-02", date)
 	if err != nil {
-		return fmt.Errorf("could not parsedTime the day of highlight from %v: %w", record[2], err)
+		return fmt.Errorf("could not parsedTime the day of highlight from %v: %w", date, err)
 	}
 	a := &model.Annotation{
-		BookId:   book.Id,
-		Text:     record[6],
-		Location: model.Location{},
-		Ts:       parsedTime,
-		Origin:   record[3],
-		Type:     model.Highlight,
+		BookId:     book.Id,
+		Text:       h.get(record, columnHighlight),
+		Location:   model.Location{},
+		Ts:         parsedTime,
+		Origin:     bookUrl,
+		Type:       model.Highlight,
+		Chapter:    chapter(h.get(record, columnChapterTitle), h.get(record, columnChapterUrl)),
+		Source:     Source,
+		ExternalId: h.get(record, columnHighlightUrl),
+	}
+	// personal note is stored as a note next to its highlight, like Kindle stores notes
+	note := *a
+	if err := e.upsertAnnotation(ctx, a); err != nil {
+		return err
+	}
+	if text := strings.TrimSpace(h.get(record, columnPersonalNote)); text != "" {
+		note.Text = text
+		note.Type = model.Note
+		if note.ExternalId != "" {
+			note.ExternalId += noteExternalIdSuffix
+		}
+		return e.upsertAnnotation(ctx, &note)
 	}
+	return nil
+}
+
+// noteExternalIdSuffix tells apart the note from its highlight, since both come from the same exported row
+const noteExternalIdSuffix = "#note"
+
+func (e *ContentExtractor) upsertAnnotation(ctx context.Context, a *model.Annotation) error {
 	existed, err := e.annotationRepo.UpsertAnnotation(ctx, a)
 	if err != nil {
-		log.Errorf("Failed to upsert an annotation: %v", err)
-		return
+		return fmt.Errorf("failed to upsert an annotation: %w", err)
 	}
 	if existed {
 		e.annotationsUpdated++
 	} else {
 		e.annotationsInserted++
 	}
+	return nil
+}
 
-	return
+// chapter ordinal is not exported by O'Reilly, but chapter pages are usually named like ch03.html
+func chapter(title string, url string) model.Chapter {
+	c := model.Chapter{
+		Title: title,
+		Url:   url,
+	}
+	if submatch := chapterOrdinalRegex.FindStringSubmatch(url); len(submatch) != 0 {
+		c.Ordinal = utils.MustItoa(submatch[1])
+	}
+	return c
 }
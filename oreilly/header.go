@@ -0,0 +1,100 @@
+package oreilly
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+const (
+	columnBookTitle     = "Book Title"
+	columnAuthors       = "Authors"
+	columnChapterTitle  = "Chapter Title"
+	columnDate          = "Date of Highlight"
+	columnBookUrl       = "Book URL"
+	columnChapterUrl    = "Chapter URL"
+	columnHighlightUrl  = "Highlight URL"
+	columnHighlight     = "Highlight"
+	columnPersonalNote  = "Personal Note"
+	columnAnnotationUrl = "Annotation URL"
+)
+
+var (
+	requiredColumns = []string{
+		columnBookTitle,
+		columnDate,
+		columnBookUrl,
+		columnHighlight,
+	}
+	optionalColumns = []string{
+		columnAuthors,
+		columnChapterTitle,
+		columnChapterUrl,
+		columnHighlightUrl,
+		columnPersonalNote,
+	}
+	// O'Reilly renamed some of the columns between export versions
+	columnAliases = map[string]string{
+		columnAnnotationUrl: columnHighlightUrl,
+	}
+)
+
+// header maps known column names to their position in the exported CSV
+type header map[string]int
+
+func parseHeader(record []string) (header, error) {
+	h := make(header)
+	for i, name := range record {
+		name = columnName(name)
+		if !isKnownColumn(name) {
+			log.Warnf("Ignoring unknown column in CSV: %v", name)
+			continue
+		}
+		h[name] = i
+	}
+	if missing := h.missing(); len(missing) > 0 {
+		return nil, fmt.Errorf("CSV does not have expected format: %+v encountered, but required columns %+v are missing", record, missing)
+	}
+	return h, nil
+}
+
+// columnName normalizes the name of a column as exported, so that all export versions use the same names
+func columnName(name string) string {
+	name = strings.TrimSpace(strings.TrimPrefix(name, "\uFEFF"))
+	if alias, ok := columnAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+func (h header) missing() (missing []string) {
+	for _, name := range requiredColumns {
+		if _, ok := h[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+func isKnownColumn(name string) bool {
+	for _, known := range requiredColumns {
+		if known == name {
+			return true
+		}
+	}
+	for _, known := range optionalColumns {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns value of the column in the record, or an empty string if the column was not exported
+func (h header) get(record []string, name string) string {
+	i, ok := h[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return record[i]
+}
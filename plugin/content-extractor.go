@@ -0,0 +1,206 @@
+// Package plugin ingests annotations of external tools, which write them as JSON Lines (see protocol.go)
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strings"
+	"time"
+)
+
+// Format is the name of the extractor; the source of annotations is the one the plugin writes in its header
+const Format = "jsonl"
+
+const maxLineSize = 1024 * 1024
+
+type line struct {
+	number int
+	text   string
+}
+
+type ContentExtractor struct {
+	bookRepo            model.BookRepository
+	annotationRepo      model.AnnotationRepository
+	annotationsUpdated  int
+	annotationsInserted int
+	invalid             int
+	origin              string
+	progress            *model.Progress[line]
+	// source is read from the header, books maps refs of the books to their Ids
+	source string
+	books  map[string]int64
+}
+
+func NewContentExtractor(bookRepo model.BookRepository, annotationRepo model.AnnotationRepository, origin string) *ContentExtractor {
+	return &ContentExtractor{
+		bookRepo:       model.NewCachedBookRepository(bookRepo),
+		annotationRepo: annotationRepo,
+		origin:         origin,
+		progress:       model.NewProgress[line](nil),
+	}
+}
+
+func (e *ContentExtractor) Name() string {
+	return Format
+}
+
+// Detect recognizes the output of a plugin by its header
+func (e *ContentExtractor) Detect(head []byte) bool {
+	first, _, _ := bytes.Cut(head, []byte("\n"))
+	_, err := ParseHeader(first)
+	return err == nil
+}
+
+func (e *ContentExtractor) ResumeFrom(c *model.Checkpoint) {
+	e.progress = model.NewProgress[line](c)
+}
+
+func (e *ContentExtractor) Checkpoint() model.Checkpoint {
+	return e.progress.Checkpoint()
+}
+
+// IngestRecords ingests books as they come and annotations through the checkpoint progress, so that books
+// referred to by annotations are known also when resuming. Invalid records are reported and skipped
+func (e *ContentExtractor) IngestRecords(ctx context.Context, reader io.Reader) (err error) {
+	begin := time.Now()
+	e.source, e.books, e.invalid = "", make(map[string]int64), 0
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	number := 0
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return e.interrupted(err)
+		}
+		number++
+		text := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\uFEFF"))
+		if text == "" {
+			continue
+		}
+		if e.source == "" {
+			h, err := ParseHeader([]byte(text))
+			if err != nil {
+				return fmt.Errorf("line %d of %v: %w", number, e.origin, err)
+			}
+			e.source = h.Source
+			continue
+		}
+		kind, err := recordKind([]byte(text))
+		switch {
+		case err != nil:
+			e.reportInvalid(number, err)
+		case kind == recordBook:
+			if err := e.ingestBook(ctx, line{number: number, text: text}); err != nil {
+				return err
+			}
+		case kind == recordAnnotation:
+			if err := e.ingestAnnotations(ctx, e.progress.Track(line{number: number, text: text}, text)); err != nil {
+				return err
+			}
+		default:
+			e.reportInvalid(number, fmt.Errorf("%w: unknown record %q", ErrInvalidRecord, kind))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %v: %w", e.origin, err)
+	}
+	if err := e.ingestAnnotations(ctx, e.progress.Flush()); err != nil {
+		return err
+	}
+	if e.source == "" {
+		return fmt.Errorf("%v has no header", e.origin)
+	}
+	if e.invalid > 0 {
+		log.Warnf("Skipped %d invalid records of %v", e.invalid, e.origin)
+	}
+	log.Infof("Ingestion completed from origin %v (source %v) in %dms; updated %v annotations and created %v new ones",
+		e.origin, e.source, time.Now().Sub(begin).Milliseconds(), e.annotationsUpdated, e.annotationsInserted)
+	return nil
+}
+
+// ingestBook reports an invalid book and skips it, but fails if a valid one can't be stored
+func (e *ContentExtractor) ingestBook(ctx context.Context, l line) error {
+	var r bookRecord
+	if err := decodeStrict([]byte(l.text), &r); err != nil {
+		e.reportInvalid(l.number, err)
+		return nil
+	}
+	book, err := r.book(e.source)
+	if err != nil {
+		e.reportInvalid(l.number, err)
+		return nil
+	}
+	if _, ok := e.books[r.Ref]; ok {
+		e.reportInvalid(l.number, fmt.Errorf("%w: book %q was already written", ErrInvalidRecord, r.Ref))
+		return nil
+	}
+	if _, err := e.bookRepo.UpsertBook(ctx, book); err != nil {
+		return fmt.Errorf("failed to upsert a book of line %d: %w", l.number, err)
+	}
+	e.books[r.Ref] = book.Id
+	return nil
+}
+
+func (e *ContentExtractor) ingestAnnotations(ctx context.Context, lines []line) error {
+	for _, l := range lines {
+		err := e.ingestAnnotation(ctx, l)
+		// annotation might not have been stored if cancellation interrupted it
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return e.interrupted(ctxErr)
+		}
+		if err != nil {
+			return err
+		}
+		e.progress.Done()
+	}
+	return nil
+}
+
+// ingestAnnotation reports an invalid annotation and skips it, but fails if a valid one can't be stored
+func (e *ContentExtractor) ingestAnnotation(ctx context.Context, l line) error {
+	var r annotationRecord
+	if err := decodeStrict([]byte(l.text), &r); err != nil {
+		e.reportInvalid(l.number, err)
+		return nil
+	}
+	bookId, ok := e.books[r.Book]
+	if !ok {
+		e.reportInvalid(l.number, fmt.Errorf("%w: annotation refers to book %q, which was not written before it", ErrInvalidRecord, r.Book))
+		return nil
+	}
+	a, err := r.annotation(bookId, e.source)
+	if err != nil {
+		e.reportInvalid(l.number, err)
+		return nil
+	}
+	existed, err := e.annotationRepo.UpsertAnnotation(ctx, a)
+	if err != nil {
+		return fmt.Errorf("failed to upsert an annotation of line %d: %w", l.number, err)
+	}
+	if existed {
+		e.annotationsUpdated++
+	} else {
+		e.annotationsInserted++
+	}
+	return nil
+}
+
+// InvalidRecords counts the invalid records which were skipped
+func (e *ContentExtractor) InvalidRecords() int {
+	return e.invalid
+}
+
+func (e *ContentExtractor) reportInvalid(number int, err error) {
+	e.invalid++
+	log.Errorf("Line %d of %v: %v", number, e.origin, err)
+}
+
+func (e *ContentExtractor) interrupted(err error) error {
+	log.Warnf("Ingestion from origin %v interrupted after %d records; updated %v annotations and created %v new ones",
+		e.origin, e.progress.Records(), e.annotationsUpdated, e.annotationsInserted)
+	return err
+}
@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"context"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInvalidRecordsFailTheImportRun(t *testing.T) {
+	ctx := context.Background()
+	db, err := model.OpenDatabase(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	session, err := model.NewBulkSession(ctx, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints, err := model.NewDBCheckpointRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs, err := model.NewDBImportRunRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Join([]string{
+		`{"record":"header","version":1,"source":"wiki"}`,
+		`{"record":"book","ref":"b1","name":"Team Topologies"}`,
+		`{"record":"annotation","book":"b1","type":"highlight","text":"Valid","ts":"2023-03-01T10:00:00Z"}`,
+		`{"record":"annotation","book":"b2","type":"highlight","text":"Unknown book","ts":"2023-03-01T10:00:00Z"}`,
+		`{"record":"annotation","book":"b1","type":"scribble","text":"Unknown type","ts":"2023-03-01T10:00:00Z"}`,
+	}, "\n")
+	extractor := NewContentExtractor(session.BookRepository(), session.AnnotationRepository(), "wiki.jsonl")
+	run := &model.ImportRun{Source: "wiki", Origin: "wiki.jsonl"}
+	if err := model.Ingest(ctx, session, checkpoints, runs, extractor, run, strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if run.Inserted != 1 || run.Failed != 2 {
+		t.Errorf("expected 1 inserted and 2 failed records, got %d inserted and %d failed", run.Inserted, run.Failed)
+	}
+}
@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/milanaleksic/tt-extractor-kindle/isbn"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"regexp"
+	"time"
+)
+
+// ProtocolVersion is the version of the schema of the records, plugins have to write it in their header
+const ProtocolVersion = 1
+
+const (
+	recordHeader     = "header"
+	recordBook       = "book"
+	recordAnnotation = "annotation"
+)
+
+var (
+	ErrInvalidRecord = errors.New("invalid record")
+	sourceRegex      = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+)
+
+// Header is the first line a plugin writes; Source names the tool the annotations come from, it is stored
+// with every annotation and selects merge policies like any other source
+type Header struct {
+	Record  string `json:"record"`
+	Version int    `json:"version"`
+	Source  string `json:"source"`
+}
+
+// bookRecord is model.Book of the plugin; annotations refer to it by its Ref, which is meaningful only within
+// the output of a single run of the plugin
+type bookRecord struct {
+	Record  string `json:"record"`
+	Ref     string `json:"ref"`
+	Name    string `json:"name"`
+	Authors string `json:"authors"`
+	Isbn    string `json:"isbn"`
+}
+
+// annotationRecord is model.Annotation of the plugin
+type annotationRecord struct {
+	Record     string         `json:"record"`
+	Book       string         `json:"book"`
+	Type       string         `json:"type"`
+	Text       string         `json:"text"`
+	Ts         string         `json:"ts"`
+	Location   model.Location `json:"location"`
+	Chapter    chapterRecord  `json:"chapter"`
+	Origin     string         `json:"origin"`
+	ExternalId string         `json:"externalId"`
+}
+
+type chapterRecord struct {
+	Title   string `json:"title"`
+	Url     string `json:"url"`
+	Ordinal *int   `json:"ordinal"`
+}
+
+// ParseHeader parses and validates the first line of the output of a plugin
+func ParseHeader(line []byte) (*Header, error) {
+	line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("\uFEFF")))
+	var h Header
+	if err := decodeStrict(line, &h); err != nil {
+		return nil, err
+	}
+	switch {
+	case h.Record != recordHeader:
+		return nil, fmt.Errorf("%w: the first record has to be the header, not %q", ErrInvalidRecord, h.Record)
+	case h.Version != ProtocolVersion:
+		return nil, fmt.Errorf("%w: protocol version %d is not supported, only %d is", ErrInvalidRecord, h.Version, ProtocolVersion)
+	case !sourceRegex.MatchString(h.Source):
+		return nil, fmt.Errorf("%w: source %q has to be lowercase letters, digits, _ and -", ErrInvalidRecord, h.Source)
+	}
+	return &h, nil
+}
+
+// recordKind tells what kind of record the line is, without validating the rest of it
+func recordKind(line []byte) (string, error) {
+	var r struct {
+		Record string `json:"record"`
+	}
+	if err := json.Unmarshal(line, &r); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	return r.Record, nil
+}
+
+func (b *bookRecord) book(source string) (*model.Book, error) {
+	switch {
+	case b.Ref == "":
+		return nil, fmt.Errorf("%w: book has no ref", ErrInvalidRecord)
+	case b.Name == "":
+		return nil, fmt.Errorf("%w: book %q has no name", ErrInvalidRecord, b.Ref)
+	}
+	book := &model.Book{Name: b.Name, Authors: b.Authors, Source: source}
+	if b.Isbn != "" {
+		normalized, err := isbn.Normalize(b.Isbn)
+		if err != nil {
+			return nil, fmt.Errorf("%w: book %q: %v", ErrInvalidRecord, b.Ref, err)
+		}
+		book.Isbn = normalized
+	}
+	return book, nil
+}
+
+func (a *annotationRecord) annotation(bookId int64, source string) (*model.Annotation, error) {
+	if a.Type != string(model.Highlight) && a.Type != string(model.Note) {
+		return nil, fmt.Errorf("%w: type has to be %v or %v, not %q", ErrInvalidRecord, model.Highlight, model.Note, a.Type)
+	}
+	if a.Text == "" {
+		return nil, fmt.Errorf("%w: annotation has no text", ErrInvalidRecord)
+	}
+	ts, err := time.Parse(time.RFC3339, a.Ts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: ts has to be an RFC 3339 time like 2022-01-31T15:04:05Z, not %q", ErrInvalidRecord, a.Ts)
+	}
+	return &model.Annotation{
+		BookId:     bookId,
+		Text:       a.Text,
+		Location:   a.Location,
+		Ts:         ts.UTC(),
+		Origin:     a.Origin,
+		Type:       model.AnnotationType(a.Type),
+		Chapter:    model.Chapter{Title: a.Chapter.Title, Url: a.Chapter.Url, Ordinal: a.Chapter.Ordinal},
+		Source:     source,
+		ExternalId: a.ExternalId,
+	}, nil
+}
+
+// decodeStrict refuses fields which are not in the schema, since they are most likely misspelled
+func decodeStrict(line []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"errors"
+	"github.com/milanaleksic/tt-extractor-kindle/model"
+	"testing"
+	"time"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		source string
+		err    bool
+	}{
+		{name: "valid", line: `{"record":"header","version":1,"source":"wiki"}`, source: "wiki"},
+		{name: "byte order mark", line: "\uFEFF" + `{"record":"header","version":1,"source":"wiki_2-b"}`, source: "wiki_2-b"},
+		{name: "not a header", line: `{"record":"book","version":1,"source":"wiki"}`, err: true},
+		{name: "unsupported version", line: `{"record":"header","version":2,"source":"wiki"}`, err: true},
+		{name: "uppercase source", line: `{"record":"header","version":1,"source":"Wiki"}`, err: true},
+		{name: "empty source", line: `{"record":"header","version":1,"source":""}`, err: true},
+		{name: "unknown field", line: `{"record":"header","version":1,"source":"wiki","extra":true}`, err: true},
+		{name: "not JSON", line: `record=header`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseHeader([]byte(tt.line))
+			if tt.err {
+				if !errors.Is(err, ErrInvalidRecord) {
+					t.Errorf("ParseHeader(%q) error = %v, expected %v", tt.line, err, ErrInvalidRecord)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseHeader(%q) failed: %v", tt.line, err)
+			}
+			if h.Source != tt.source {
+				t.Errorf("ParseHeader(%q) source = %q, expected %q", tt.line, h.Source, tt.source)
+			}
+		})
+	}
+}
+
+func TestBookRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		isbn string
+		err  bool
+	}{
+		{name: "valid", line: `{"record":"book","ref":"b1","name":"Team Topologies","authors":"Skelton"}`},
+		{name: "normalized ISBN", line: `{"record":"book","ref":"b1","name":"DDIA","isbn":"0-306-40615-2"}`, isbn: "9780306406157"},
+		{name: "invalid ISBN", line: `{"record":"book","ref":"b1","name":"DDIA","isbn":"0-306-40615-3"}`, err: true},
+		{name: "no ref", line: `{"record":"book","name":"DDIA"}`, err: true},
+		{name: "no name", line: `{"record":"book","ref":"b1"}`, err: true},
+		{name: "misspelled field", line: `{"record":"book","ref":"b1","name":"DDIA","author":"Kleppmann"}`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r bookRecord
+			err := decodeStrict([]byte(tt.line), &r)
+			if err == nil {
+				var book *model.Book
+				if book, err = r.book("wiki"); err == nil && book.Isbn != tt.isbn {
+					t.Errorf("ISBN of %q = %q, expected %q", tt.line, book.Isbn, tt.isbn)
+				}
+			}
+			if tt.err != (err != nil) || err != nil && !errors.Is(err, ErrInvalidRecord) {
+				t.Errorf("book of %q error = %v, expected an error: %v", tt.line, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAnnotationRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		err  bool
+	}{
+		{name: "valid", line: `{"record":"annotation","book":"b1","type":"highlight","text":"Text","ts":"2023-03-01T10:00:00Z"}`},
+		{name: "complete", line: `{"record":"annotation","book":"b1","type":"note","text":"Text","ts":"2023-03-01T12:00:00+02:00",` +
+			`"location":{"pageStart":10,"locationStart":150},"chapter":{"title":"Intro","ordinal":1},"origin":"https://wiki","externalId":"w-1"}`},
+		{name: "unknown type", line: `{"record":"annotation","book":"b1","type":"bookmark","text":"Text","ts":"2023-03-01T10:00:00Z"}`, err: true},
+		{name: "no text", line: `{"record":"annotation","book":"b1","type":"note","text":"","ts":"2023-03-01T10:00:00Z"}`, err: true},
+		{name: "date without time", line: `{"record":"annotation","book":"b1","type":"note","text":"Text","ts":"2023-03-01"}`, err: true},
+		{name: "unknown location field", line: `{"record":"annotation","book":"b1","type":"note","text":"Text","ts":"2023-03-01T10:00:00Z","location":{"page":1}}`, err: true},
+		{name: "wrong value type", line: `{"record":"annotation","book":"b1","type":"note","text":"Text","ts":"2023-03-01T10:00:00Z","chapter":{"ordinal":"1"}}`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r annotationRecord
+			err := decodeStrict([]byte(tt.line), &r)
+			if err == nil {
+				var a *model.Annotation
+				if a, err = r.annotation(7, "wiki"); err == nil && (a.BookId != 7 || a.Source != "wiki" || a.Ts.Location() != time.UTC) {
+					t.Errorf("annotation of %q = %+v, expected it in book 7 of source wiki with UTC time", tt.line, a)
+				}
+			}
+			if tt.err != (err != nil) || err != nil && !errors.Is(err, ErrInvalidRecord) {
+				t.Errorf("annotation of %q error = %v, expected an error: %v", tt.line, err, tt.err)
+			}
+		})
+	}
+}
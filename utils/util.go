@@ -3,6 +3,7 @@ package utils
 import (
 	log "github.com/sirupsen/logrus"
 	"io"
+	"runtime/debug"
 	"strconv"
 )
 
@@ -18,14 +19,23 @@ func MustItoa(s string) *int {
 	return &result
 }
 
-func MustCheck(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func SafeClose(c io.Closer, err *error) {
 	if cerr := c.Close(); cerr != nil && *err == nil {
 		*err = cerr
 	}
 }
+
+// ToolVersion describes the build of the running binary: module version and VCS revision, if known
+func ToolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			version += " " + setting.Value
+		}
+	}
+	return version
+}